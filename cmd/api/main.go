@@ -51,7 +51,11 @@ func main() {
 		os.Exit(1)
 	}
 
-	server := server.NewServer()
+	server, err := server.NewServer()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
 
 	// Create a done channel to signal when the shutdown is complete
 	done := make(chan bool, 1)
@@ -0,0 +1,294 @@
+// Package apikey manages the long-lived API keys of projects. Keys are
+// stored as Secrets in a system namespace, holding only a hash of the key.
+package apikey
+
+import (
+	"cloud/internal/clusters"
+	"cloud/internal/clusters/k8s"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// Prefix starts every API key, telling them apart from JWTs.
+	Prefix = "anvil_"
+
+	secretPrefix       = "apikey-"
+	keyLabel           = "anvil.io/api-key"
+	projectLabel       = "anvil.io/api-key-project"
+	nameAnnotation     = "anvil.io/name"
+	scopesAnnotation   = "anvil.io/scopes"
+	creatorAnnotation  = "anvil.io/created-by"
+	lastUsedAnnotation = "anvil.io/last-used"
+	hashKey            = "sha256"
+
+	// touchInterval limits how often the last used timestamp of a key is
+	// written back.
+	touchInterval = time.Minute
+)
+
+// touched holds when this process last wrote back the timestamp of each
+// key, as the timestamp read with a key is stale until the write lands and
+// every request made with it meanwhile would write it again.
+var (
+	touchedMu sync.Mutex
+	touched   = map[string]time.Time{}
+)
+
+// ErrInvalid is returned for keys that are malformed, unknown or revoked.
+var ErrInvalid = errors.New("invalid API key")
+
+// Key describes an API key. The key itself is only known when created.
+type Key struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name,omitempty"`
+	Project   string     `json:"project"`
+	Scopes    []string   `json:"scopes"`
+	CreatedBy string     `json:"created_by,omitempty"`
+	Created   time.Time  `json:"created"`
+	LastUsed  *time.Time `json:"last_used,omitempty"`
+}
+
+func newKey(secret *corev1.Secret) *Key {
+	key := &Key{
+		ID:        strings.TrimPrefix(secret.Name, secretPrefix),
+		Name:      secret.Annotations[nameAnnotation],
+		Project:   secret.Labels[projectLabel],
+		Scopes:    strings.Split(secret.Annotations[scopesAnnotation], ","),
+		CreatedBy: secret.Annotations[creatorAnnotation],
+		Created:   secret.CreationTimestamp.Time,
+	}
+	if lastUsed, err := time.Parse(time.RFC3339, secret.Annotations[lastUsedAnnotation]); err == nil {
+		key.LastUsed = &lastUsed
+	}
+	return key
+}
+
+// Store keeps API keys in a namespace of a cluster.
+type Store struct {
+	kubeconfig string
+	namespace  string
+}
+
+func NewStore(kubeconfig, namespace string) *Store {
+	return &Store{kubeconfig: kubeconfig, namespace: namespace}
+}
+
+// Create generates a key for a project, returning it along with its
+// description. The key cannot be recovered afterwards.
+func (s *Store) Create(ctx context.Context, project, name, createdBy string, scopes []string) (*Key, string, error) {
+	ctx, cancel := clusters.WithTimeout(ctx)
+	defer cancel()
+	id, secret, err := generate()
+	if err != nil {
+		return nil, "", err
+	}
+	sort.Strings(scopes)
+	object := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secretPrefix + id,
+			Namespace: s.namespace,
+			Labels: map[string]string{
+				keyLabel:     "true",
+				projectLabel: project,
+			},
+			Annotations: map[string]string{
+				nameAnnotation:    name,
+				scopesAnnotation:  strings.Join(scopes, ","),
+				creatorAnnotation: createdBy,
+			},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{hashKey: []byte(hash(secret))},
+	}
+	if err := s.ensureNamespace(ctx); err != nil {
+		return nil, "", err
+	}
+	object, err = k8s.NewResource(s.kubeconfig).CreateSecret(ctx, object)
+	if err != nil {
+		return nil, "", err
+	}
+	return newKey(object), Prefix + id + "_" + secret, nil
+}
+
+// List describes the keys of a project.
+func (s *Store) List(ctx context.Context, project string) ([]*Key, error) {
+	ctx, cancel := clusters.WithTimeout(ctx)
+	defer cancel()
+	list, err := k8s.NewResource(s.kubeconfig).Secrets(ctx, s.namespace, metav1.ListOptions{
+		LabelSelector: keyLabel + "=true," + projectLabel + "=" + project,
+	})
+	if err != nil {
+		return nil, err
+	}
+	keys := []*Key{}
+	for i := range list.Items {
+		keys = append(keys, newKey(&list.Items[i]))
+	}
+	return keys, nil
+}
+
+// Delete revokes a key of a project.
+func (s *Store) Delete(ctx context.Context, project, id string) error {
+	ctx, cancel := clusters.WithTimeout(ctx)
+	defer cancel()
+	secret, err := s.get(ctx, id)
+	if err == nil && secret.Labels[projectLabel] != project {
+		err = k8serrors.NewNotFound(corev1.Resource("apikeys"), id)
+	}
+	if err != nil {
+		return err
+	}
+	return k8s.NewResource(s.kubeconfig).DeleteSecret(ctx, s.namespace, secret.Name)
+}
+
+// DeleteAll revokes every key of a project, as keys would otherwise outlive
+// it and apply again to a project re-created under the same name.
+func (s *Store) DeleteAll(ctx context.Context, project string) error {
+	ctx, cancel := clusters.WithTimeout(ctx)
+	defer cancel()
+	resource := k8s.NewResource(s.kubeconfig)
+	list, err := resource.Secrets(ctx, s.namespace, metav1.ListOptions{
+		LabelSelector: keyLabel + "=true," + projectLabel + "=" + project,
+	})
+	if err != nil {
+		return err
+	}
+	for _, secret := range list.Items {
+		err := resource.DeleteSecret(ctx, s.namespace, secret.Name)
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Verify returns the description of a key, or ErrInvalid when it is not a
+// known key. The last used timestamp of the key is updated in passing.
+func (s *Store) Verify(ctx context.Context, token string) (*Key, error) {
+	id, secret, ok := parse(token)
+	if !ok {
+		return nil, ErrInvalid
+	}
+	ctx, cancel := clusters.WithTimeout(ctx)
+	defer cancel()
+	object, err := s.get(ctx, id)
+	if k8serrors.IsNotFound(err) {
+		return nil, ErrInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(object.Data[hashKey], []byte(hash(secret))) != 1 {
+		return nil, ErrInvalid
+	}
+	key := newKey(object)
+	if (key.LastUsed == nil || time.Since(*key.LastUsed) > touchInterval) && claimTouch(object.Name, time.Now()) {
+		go s.touch(object)
+	}
+	return key, nil
+}
+
+// touch records that a key was just used. Failures are ignored as the
+// timestamp is informational.
+func (s *Store) touch(secret *corev1.Secret) {
+	ctx, cancel := clusters.WithTimeout(context.Background())
+	defer cancel()
+	secret = secret.DeepCopy()
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	secret.Annotations[lastUsedAnnotation] = time.Now().UTC().Format(time.RFC3339)
+	_, _ = k8s.NewResource(s.kubeconfig).UpdateSecret(ctx, secret)
+}
+
+// claimTouch reports whether the timestamp of a key may be written back
+// now, at most once per touchInterval. Entries of keys not used for as long
+// are dropped on the way.
+func claimTouch(name string, now time.Time) bool {
+	touchedMu.Lock()
+	defer touchedMu.Unlock()
+	if now.Sub(touched[name]) < touchInterval {
+		return false
+	}
+	for other, at := range touched {
+		if now.Sub(at) >= touchInterval {
+			delete(touched, other)
+		}
+	}
+	touched[name] = now
+	return true
+}
+
+func (s *Store) get(ctx context.Context, id string) (*corev1.Secret, error) {
+	secret, err := k8s.NewResource(s.kubeconfig).Secret(ctx, s.namespace, secretPrefix+id)
+	if err == nil && secret.Labels[keyLabel] != "true" {
+		err = k8serrors.NewNotFound(corev1.Resource("apikeys"), id)
+	}
+	return secret, err
+}
+
+// ensureNamespace creates the namespace keys are stored in when missing.
+func (s *Store) ensureNamespace(ctx context.Context) error {
+	clientSet, err := k8s.ClientSet(s.kubeconfig)
+	if err != nil {
+		return err
+	}
+	_, err = clientSet.CoreV1().Namespaces().Create(ctx, &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: s.namespace},
+	}, metav1.CreateOptions{})
+	if k8serrors.IsAlreadyExists(err) {
+		return nil
+	}
+	return err
+}
+
+// generate returns the identifier and secret part of a new key. The
+// identifier is lowercase hex so that it can be part of a Secret name.
+func generate() (string, string, error) {
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return "", "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(id), base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// parse splits a key into its identifier and secret part.
+func parse(token string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(token, Prefix)
+	if !ok {
+		return "", "", false
+	}
+	id, secret, ok := strings.Cut(rest, "_")
+	if !ok || id == "" || secret == "" {
+		return "", "", false
+	}
+	if _, err := hex.DecodeString(id); err != nil {
+		return "", "", false
+	}
+	return id, secret, true
+}
+
+// hash is what is stored of the secret part of a key. A fast hash suffices
+// as secrets are random and long.
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,68 @@
+package apikey
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGenerateAndParse(t *testing.T) {
+	id, secret, err := generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsedID, parsedSecret, ok := parse(Prefix + id + "_" + secret)
+	if !ok || parsedID != id || parsedSecret != secret {
+		t.Errorf("parse did not round trip: %q %q %v", parsedID, parsedSecret, ok)
+	}
+	for _, token := range []string{"eyJhbGciOi.x.y", Prefix + "nothex_secret", Prefix + id, Prefix + id + "_"} {
+		if _, _, ok := parse(token); ok {
+			t.Errorf("expected %q not to parse", token)
+		}
+	}
+	if hash(secret) == secret || hash(secret) != hash(secret) {
+		t.Error("expected a stable hash that differs from the secret")
+	}
+}
+
+func TestNewKey(t *testing.T) {
+	key := newKey(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   secretPrefix + "0123abcd",
+			Labels: map[string]string{projectLabel: "swift-abc"},
+			Annotations: map[string]string{
+				scopesAnnotation:   "power,read",
+				lastUsedAnnotation: "2026-10-18T09:00:00Z",
+			},
+		},
+		Data: map[string][]byte{hashKey: []byte("digest")},
+	})
+	if key.ID != "0123abcd" || key.Project != "swift-abc" || len(key.Scopes) != 2 {
+		t.Errorf("unexpected key %+v", key)
+	}
+	if key.LastUsed == nil || key.LastUsed.Hour() != 9 {
+		t.Errorf("unexpected last used %v", key.LastUsed)
+	}
+}
+
+func TestClaimTouch(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name  string
+		key   string
+		at    time.Time
+		claim bool
+	}{
+		{"first use", "apikey-a", now, true},
+		{"again within the interval", "apikey-a", now.Add(touchInterval / 2), false},
+		{"another key", "apikey-b", now.Add(touchInterval / 2), true},
+		{"after the interval", "apikey-a", now.Add(touchInterval), true},
+	}
+	for _, test := range tests {
+		if got := claimTouch(test.key, test.at); got != test.claim {
+			t.Errorf("%s: expected %v, got %v", test.name, test.claim, got)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package clusters
+
+import (
+	"cloud/internal/clusters/k8s"
+	"context"
+	"sort"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+)
+
+// readCache serves reads of selected kinds from shared informers that
+// watch every namespace of a cluster.
+type readCache struct {
+	factory   dynamicinformer.DynamicSharedInformerFactory
+	informers map[schema.GroupVersionKind]cachedKind
+}
+
+type cachedKind struct {
+	resource schema.GroupResource
+	informer informers.GenericInformer
+}
+
+var (
+	cachesMu sync.RWMutex
+	caches   = map[string]*readCache{}
+)
+
+// StartCache starts informers for the given kinds on the cluster of a
+// kubeconfig. They run until ctx is done, and reads through
+// CachedGetResourceSchema and CachedListResourceSchema are served from them
+// once they have synced.
+func StartCache(ctx context.Context, config string, gvks ...schema.GroupVersionKind) error {
+	clients, err := k8s.ClientsFor(config)
+	if err != nil {
+		return err
+	}
+	c := &readCache{
+		factory:   dynamicinformer.NewDynamicSharedInformerFactory(clients.Dynamic, 0),
+		informers: map[schema.GroupVersionKind]cachedKind{},
+	}
+	for _, gvk := range gvks {
+		mapping, err := clients.RESTMapping(gvk)
+		if err != nil {
+			return err
+		}
+		c.informers[gvk] = cachedKind{
+			resource: mapping.Resource.GroupResource(),
+			informer: c.factory.ForResource(mapping.Resource),
+		}
+	}
+	c.factory.Start(ctx.Done())
+
+	cachesMu.Lock()
+	caches[config] = c
+	cachesMu.Unlock()
+	go func() {
+		<-ctx.Done()
+		cachesMu.Lock()
+		delete(caches, config)
+		cachesMu.Unlock()
+		c.factory.Shutdown()
+	}()
+	return nil
+}
+
+// CacheStatus reports, for every cached kind, whether its informer has
+// completed the initial sync.
+func CacheStatus() map[string]bool {
+	cachesMu.RLock()
+	defer cachesMu.RUnlock()
+	status := map[string]bool{}
+	for _, c := range caches {
+		for gvk, kind := range c.informers {
+			status[gvk.GroupKind().String()] = kind.informer.Informer().HasSynced()
+		}
+	}
+	return status
+}
+
+// cachedKindFor returns the synced informer of a kind, if there is one.
+func cachedKindFor(gvk schema.GroupVersionKind, config string) (cachedKind, bool) {
+	cachesMu.RLock()
+	defer cachesMu.RUnlock()
+	c, ok := caches[config]
+	if !ok {
+		return cachedKind{}, false
+	}
+	kind, ok := c.informers[gvk]
+	if !ok || !kind.informer.Informer().HasSynced() {
+		return cachedKind{}, false
+	}
+	return kind, true
+}
+
+// CachedGetResourceSchema gets a resource from the cache. The boolean is
+// false when the kind is not cached or not yet synced, in which case the
+// caller should read from the API server instead.
+func CachedGetResourceSchema(gvk schema.GroupVersionKind, name, config, namespace string) (*unstructured.Unstructured, bool, error) {
+	kind, ok := cachedKindFor(gvk, config)
+	if !ok {
+		return nil, false, nil
+	}
+	obj, err := kind.informer.Lister().ByNamespace(namespace).Get(name)
+	if errors.IsNotFound(err) {
+		return nil, true, errors.NewNotFound(kind.resource, name)
+	}
+	if err != nil {
+		return nil, true, err
+	}
+	item, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, false, nil
+	}
+	return item.DeepCopy(), true, nil
+}
+
+// CachedListResourceSchema lists the resources of a namespace matching
+// selector from the cache, ordered by name. The boolean is false when the
+// kind is not cached or not yet synced.
+func CachedListResourceSchema(gvk schema.GroupVersionKind, config, namespace string, selector labels.Selector) (*unstructured.UnstructuredList, bool, error) {
+	kind, ok := cachedKindFor(gvk, config)
+	if !ok {
+		return nil, false, nil
+	}
+	objs, err := kind.informer.Lister().ByNamespace(namespace).List(selector)
+	if err != nil {
+		return nil, true, err
+	}
+	list := &unstructured.UnstructuredList{}
+	list.SetResourceVersion(kind.informer.Informer().LastSyncResourceVersion())
+	for _, obj := range objs {
+		item, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			return nil, false, nil
+		}
+		list.Items = append(list.Items, *item.DeepCopy())
+	}
+	sort.Slice(list.Items, func(i, j int) bool {
+		return list.Items[i].GetName() < list.Items[j].GetName()
+	})
+	return list, true, nil
+}
@@ -1,23 +1,129 @@
 package k8s
 
 import (
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
 	"k8s.io/client-go/tools/clientcmd"
+	"kubevirt.io/client-go/kubecli"
 )
 
-func ClientSet(kubeconfig string) (*kubernetes.Clientset, error) {
+// Clients are the long-lived clients of a single cluster. They are safe for
+// concurrent use and shared by every request made with the same kubeconfig.
+type Clients struct {
+	Config    *rest.Config
+	Clientset *kubernetes.Clientset
+	Dynamic   dynamic.Interface
+	Kubevirt  kubecli.KubevirtClient
+	mapper    meta.ResettableRESTMapper
+	resetMu   sync.Mutex
+	lastReset time.Time
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = map[string]*Clients{}
+)
+
+// ClientsFor returns the clients for a kubeconfig, building them on first
+// use. API discovery is deferred until a mapping is first requested and
+// then served from memory. Tests replace it to serve fake clients.
+var ClientsFor = clientsFor
+
+// NewClients builds clients around a dynamic client and a mapper, such as
+// fakes in tests.
+func NewClients(dynamic dynamic.Interface, mapper meta.ResettableRESTMapper) *Clients {
+	return &Clients{Dynamic: dynamic, mapper: mapper}
+}
+
+func clientsFor(kubeconfig string) (*Clients, error) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if clients, ok := registry[kubeconfig]; ok {
+		return clients, nil
+	}
 	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
 	if err != nil {
 		return nil, err
 	}
-	return kubernetes.NewForConfig(config)
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	dyn, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	kubevirt, err := kubecli.GetKubevirtClientFromRESTConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	dc, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	clients := &Clients{
+		Config:    config,
+		Clientset: clientset,
+		Dynamic:   dyn,
+		Kubevirt:  kubevirt,
+		mapper:    restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(dc)),
+	}
+	registry[kubeconfig] = clients
+	return clients, nil
 }
 
-func DynamicClientSet(kubeconfig string) (*dynamic.DynamicClient, error) {
-	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+// mapperResetInterval limits how often an unknown kind invalidates the
+// discovery cache, as every reset costs a full discovery of the cluster.
+const mapperResetInterval = 30 * time.Second
+
+// RESTMapping maps a kind to its resource. When the kind is unknown the
+// discovery cache is invalidated and the lookup retried once, so that
+// resources installed after the cache was filled are picked up. The mapper
+// only retries by itself while its cache has never been filled: the memory
+// cache reports itself fresh from then on, so kinds installed later would
+// otherwise stay unknown until the server restarts.
+func (c *Clients) RESTMapping(gvk schema.GroupVersionKind) (*meta.RESTMapping, error) {
+	mapping, err := c.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if meta.IsNoMatchError(err) && c.claimReset() {
+		c.mapper.Reset()
+		mapping, err = c.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	}
+	return mapping, err
+}
+
+// claimReset reports whether the discovery cache may be reset now, at most
+// once per mapperResetInterval.
+func (c *Clients) claimReset() bool {
+	c.resetMu.Lock()
+	defer c.resetMu.Unlock()
+	if time.Since(c.lastReset) < mapperResetInterval {
+		return false
+	}
+	c.lastReset = time.Now()
+	return true
+}
+
+func ClientSet(kubeconfig string) (*kubernetes.Clientset, error) {
+	clients, err := ClientsFor(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return clients.Clientset, nil
+}
+
+func DynamicClientSet(kubeconfig string) (dynamic.Interface, error) {
+	clients, err := ClientsFor(kubeconfig)
 	if err != nil {
 		return nil, err
 	}
-	return dynamic.NewForConfig(config)
+	return clients.Dynamic, nil
 }
@@ -0,0 +1,46 @@
+package k8s
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: https://127.0.0.1:6443
+contexts:
+- name: test
+  context:
+    cluster: test
+    user: test
+current-context: test
+users:
+- name: test
+  user:
+    token: test
+`
+
+func TestClientsForIsCached(t *testing.T) {
+	kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+	if err := os.WriteFile(kubeconfig, []byte(testKubeconfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	first, err := ClientsFor(kubeconfig)
+	if err != nil {
+		t.Fatalf("building clients: %v", err)
+	}
+	second, err := ClientsFor(kubeconfig)
+	if err != nil {
+		t.Fatalf("building clients: %v", err)
+	}
+	if first != second {
+		t.Error("expected clients to be reused for the same kubeconfig")
+	}
+	if _, err := ClientsFor(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected an error for a missing kubeconfig")
+	}
+}
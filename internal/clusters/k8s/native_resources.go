@@ -5,6 +5,7 @@ import (
 
 	authenticationv1 "k8s.io/api/authentication/v1"
 	v1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -12,34 +13,146 @@ type Resource struct {
 	kubeconfig string
 }
 
-func (r Resource) Pods(ns string) (*v1.PodList, error) {
+func NewResource(kubeconfig string) Resource {
+	return Resource{kubeconfig: kubeconfig}
+}
+
+func (r Resource) Namespace(ctx context.Context, name string) (*v1.Namespace, error) {
+	clientSet, err := ClientSet(r.kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return clientSet.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+}
+
+func (r Resource) Pods(ctx context.Context, ns string) (*v1.PodList, error) {
+	clientSet, err := ClientSet(r.kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return clientSet.CoreV1().Pods(ns).List(ctx, metav1.ListOptions{})
+}
+
+func (r Resource) Secrets(ctx context.Context, ns string, opts metav1.ListOptions) (*v1.SecretList, error) {
+	clientSet, err := ClientSet(r.kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return clientSet.CoreV1().Secrets(ns).List(ctx, opts)
+}
+
+func (r Resource) Secret(ctx context.Context, ns, name string) (*v1.Secret, error) {
+	clientSet, err := ClientSet(r.kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return clientSet.CoreV1().Secrets(ns).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (r Resource) CreateSecret(ctx context.Context, secret *v1.Secret) (*v1.Secret, error) {
+	clientSet, err := ClientSet(r.kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return clientSet.CoreV1().Secrets(secret.Namespace).Create(ctx, secret, metav1.CreateOptions{})
+}
+
+func (r Resource) UpdateSecret(ctx context.Context, secret *v1.Secret) (*v1.Secret, error) {
+	clientSet, err := ClientSet(r.kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return clientSet.CoreV1().Secrets(secret.Namespace).Update(ctx, secret, metav1.UpdateOptions{})
+}
+
+func (r Resource) DeleteSecret(ctx context.Context, ns, name string) error {
+	clientSet, err := ClientSet(r.kubeconfig)
+	if err != nil {
+		return err
+	}
+	return clientSet.CoreV1().Secrets(ns).Delete(ctx, name, metav1.DeleteOptions{})
+}
+
+func (r Resource) ConfigMaps(ctx context.Context, ns string, opts metav1.ListOptions) (*v1.ConfigMapList, error) {
 	clientSet, err := ClientSet(r.kubeconfig)
 	if err != nil {
 		return nil, err
 	}
-	return clientSet.CoreV1().Pods(ns).List(context.Background(), metav1.ListOptions{})
+	return clientSet.CoreV1().ConfigMaps(ns).List(ctx, opts)
 }
 
-func (r Resource) Secrets(ns string) (*v1.SecretList, error) {
+func (r Resource) ConfigMap(ctx context.Context, ns, name string) (*v1.ConfigMap, error) {
 	clientSet, err := ClientSet(r.kubeconfig)
 	if err != nil {
 		return nil, err
 	}
-	return clientSet.CoreV1().Secrets(ns).List(context.Background(), metav1.ListOptions{})
+	return clientSet.CoreV1().ConfigMaps(ns).Get(ctx, name, metav1.GetOptions{})
 }
 
-func (r Resource) ConfigMaps(ns string) (*v1.ConfigMapList, error) {
+func (r Resource) CreateConfigMap(ctx context.Context, configMap *v1.ConfigMap) (*v1.ConfigMap, error) {
 	clientSet, err := ClientSet(r.kubeconfig)
 	if err != nil {
 		return nil, err
 	}
-	return clientSet.CoreV1().ConfigMaps(ns).List(context.Background(), metav1.ListOptions{})
+	return clientSet.CoreV1().ConfigMaps(configMap.Namespace).Create(ctx, configMap, metav1.CreateOptions{})
 }
 
-func (r Resource) CreateToken(ns, serviceAccount string) (*authenticationv1.TokenRequest, error) {
+func (r Resource) UpdateConfigMap(ctx context.Context, configMap *v1.ConfigMap) (*v1.ConfigMap, error) {
 	clientSet, err := ClientSet(r.kubeconfig)
 	if err != nil {
 		return nil, err
 	}
-	return clientSet.CoreV1().ServiceAccounts(ns).CreateToken(context.Background(), serviceAccount, &authenticationv1.TokenRequest{}, metav1.CreateOptions{})
+	return clientSet.CoreV1().ConfigMaps(configMap.Namespace).Update(ctx, configMap, metav1.UpdateOptions{})
+}
+
+func (r Resource) DeleteConfigMap(ctx context.Context, ns, name string) error {
+	clientSet, err := ClientSet(r.kubeconfig)
+	if err != nil {
+		return err
+	}
+	return clientSet.CoreV1().ConfigMaps(ns).Delete(ctx, name, metav1.DeleteOptions{})
+}
+
+func (r Resource) CreateServiceAccount(ctx context.Context, serviceAccount *v1.ServiceAccount) (*v1.ServiceAccount, error) {
+	clientSet, err := ClientSet(r.kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return clientSet.CoreV1().ServiceAccounts(serviceAccount.Namespace).Create(ctx, serviceAccount, metav1.CreateOptions{})
+}
+
+func (r Resource) CreateRoleBinding(ctx context.Context, roleBinding *rbacv1.RoleBinding) (*rbacv1.RoleBinding, error) {
+	clientSet, err := ClientSet(r.kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return clientSet.RbacV1().RoleBindings(roleBinding.Namespace).Create(ctx, roleBinding, metav1.CreateOptions{})
+}
+
+func (r Resource) CreateToken(ctx context.Context, ns, serviceAccount string, audiences []string, expirationSeconds int64) (*authenticationv1.TokenRequest, error) {
+	clientSet, err := ClientSet(r.kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	request := &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{
+			Audiences:         audiences,
+			ExpirationSeconds: &expirationSeconds,
+		},
+	}
+	return clientSet.CoreV1().ServiceAccounts(ns).CreateToken(ctx, serviceAccount, request, metav1.CreateOptions{})
+}
+
+func (r Resource) ReviewToken(ctx context.Context, token string, audiences []string) (*authenticationv1.TokenReview, error) {
+	clientSet, err := ClientSet(r.kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	review := &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{
+			Token:     token,
+			Audiences: audiences,
+		},
+	}
+	return clientSet.AuthenticationV1().TokenReviews().Create(ctx, review, metav1.CreateOptions{})
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"net/http"
+	"strings"
 )
 
 type Resource struct {
@@ -14,20 +15,71 @@ type Resource struct {
 }
 
 type Compute struct {
-	Name      string      `json:"name,omitempty"`
-	CPU       float64     `json:"vcpu,omitempty"`
-	RAM       string      `json:"ram,omitempty"`
-	Storage   string      `json:"storage,omitempty"`
-	Instances float64     `json:"instances,omitempty"`
-	State     string      `json:"state,omitempty"`
-	SSHKey    string      `json:"ssh_key,omitempty"`
-	URL       string      `json:"url,omitempty"`
-	Container []Container `json:"containers,omitempty"`
+	Name        string      `json:"name,omitempty"`
+	CPU         float64     `json:"vcpu,omitempty"`
+	RAM         string      `json:"ram,omitempty"`
+	Storage     string      `json:"storage,omitempty"`
+	Instances   float64     `json:"instances,omitempty"`
+	State       string      `json:"state,omitempty"`
+	SSHKey      string      `json:"ssh_key,omitempty"`
+	SSHKeys     []string    `json:"ssh_keys,omitempty"`
+	URL         string      `json:"url,omitempty"`
+	RunStrategy string      `json:"run_strategy,omitempty"`
+	Container   []Container `json:"containers,omitempty"`
+}
+
+// AuthorizedKeys returns the SSH public keys given through ssh_key, one per
+// line, followed by those given through ssh_keys.
+func (c Compute) AuthorizedKeys() []string {
+	keys := []string{}
+	for _, key := range append(strings.Split(c.SSHKey, "\n"), c.SSHKeys...) {
+		key = strings.TrimSpace(key)
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
 }
 
 type User struct {
-	Name     string `json:"name,omitempty"`
-	Password string `json:"password,omitempty"`
+	Name     string   `json:"name,omitempty"`
+	Password string   `json:"password,omitempty"`
+	SSHKeys  []string `json:"ssh_keys,omitempty"`
+	Sudo     bool     `json:"sudo,omitempty"`
+}
+
+// CloudInit holds the guest configuration applied through cloud-init on
+// first boot, in addition to the user the virtual machine is created with.
+type CloudInit struct {
+	Hostname   string      `json:"hostname,omitempty"`
+	Timezone   string      `json:"timezone,omitempty"`
+	Packages   []string    `json:"packages,omitempty"`
+	RunCmd     []string    `json:"runcmd,omitempty"`
+	WriteFiles []WriteFile `json:"write_files,omitempty"`
+	Users      []User      `json:"users,omitempty"`
+	// Datasource selects how the config is presented to the guest, either
+	// "nocloud", the default, or "configdrive".
+	Datasource string `json:"datasource,omitempty"`
+}
+
+// CloudInitData is raw cloud-init data given either inline or as the name
+// of a Secret in the project namespace holding it under the "userdata" or
+// "networkdata" key.
+type CloudInitData struct {
+	Inline string `json:"inline,omitempty"`
+	Secret string `json:"secret,omitempty"`
+	// Mode is either "merge", the default, to combine user data with the
+	// generated config, or "replace" to use it as is.
+	Mode string `json:"mode,omitempty"`
+}
+
+type WriteFile struct {
+	Path        string `json:"path,omitempty"`
+	Content     string `json:"content,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	Owner       string `json:"owner,omitempty"`
+	Permissions string `json:"permissions,omitempty"`
+	Append      bool   `json:"append,omitempty"`
 }
 
 type Container struct {
@@ -46,9 +98,12 @@ type Env struct {
 }
 
 type ResourceDetails struct {
-	ID        string  `json:"id,omitempty"`
-	Compute   Compute `json:"compute,omitempty"`
-	User      User    `json:"user,omitempty"`
+	ID          string         `json:"id,omitempty"`
+	Compute     Compute        `json:"compute,omitempty"`
+	User        User           `json:"user,omitempty"`
+	CloudInit   CloudInit      `json:"cloud_init,omitempty"`
+	UserData    *CloudInitData `json:"user_data,omitempty"`
+	NetworkData *CloudInitData `json:"network_data,omitempty"`
 }
 
 // Payload is a decoded json request payload
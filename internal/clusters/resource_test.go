@@ -0,0 +1,36 @@
+package clusters
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAuthorizedKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		compute Compute
+		keys    []string
+	}{
+		{"none", Compute{}, []string{}},
+		{"single key", Compute{SSHKey: "ssh-ed25519 AAAA arthur"}, []string{"ssh-ed25519 AAAA arthur"}},
+		{
+			"one per line",
+			Compute{SSHKey: "ssh-ed25519 AAAA arthur\r\n\n  ssh-rsa BBBB ci  \n"},
+			[]string{"ssh-ed25519 AAAA arthur", "ssh-rsa BBBB ci"},
+		},
+		{
+			"list after lines",
+			Compute{SSHKey: "ssh-ed25519 AAAA arthur", SSHKeys: []string{"ssh-rsa BBBB ci", " ", "ecdsa-sha2-nistp256 CCCC ops"}},
+			[]string{"ssh-ed25519 AAAA arthur", "ssh-rsa BBBB ci", "ecdsa-sha2-nistp256 CCCC ops"},
+		},
+		{"list only", Compute{SSHKeys: []string{"ssh-rsa BBBB ci"}}, []string{"ssh-rsa BBBB ci"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keys := test.compute.AuthorizedKeys()
+			if strings.Join(keys, "|") != strings.Join(test.keys, "|") || keys == nil {
+				t.Errorf("expected %q, got %q", test.keys, keys)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package clusters
 import (
 	"cloud/internal/clusters/k8s"
 	"context"
+	"time"
 
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -10,285 +11,122 @@ import (
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/watch"
-	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/dynamic"
-	"k8s.io/client-go/restmapper"
-	"k8s.io/client-go/tools/clientcmd"
 	"kubevirt.io/client-go/kubecli"
 )
 
-func CreateResourceSchema(resource *unstructured.Unstructured, config, namespace string) (*unstructured.Unstructured, error) {
-	cfg, err := clientcmd.BuildConfigFromFlags("", config)
-	if err != nil {
-		return nil, err
-	}
-	dc, err := discovery.NewDiscoveryClientForConfig(cfg)
-	if err != nil {
-		return nil, err
-	}
-	gr, err := restmapper.GetAPIGroupResources(dc)
-	if err != nil {
-		return nil, err
-	}
-	gvk := resource.GetObjectKind().GroupVersionKind()
-	rm := restmapper.NewDiscoveryRESTMapper(gr)
-	mapping, err := rm.RESTMapping(gvk.GroupKind(), gvk.Version)
-	if err != nil {
-		return nil, err
-	}
+// OperationTimeout bounds every create, get, list, patch and delete call
+// made to the API server. Watches are only bound by their context. A zero
+// value disables the timeout.
+var OperationTimeout = 30 * time.Second
 
-	var ri dynamic.ResourceInterface
-	dyn, err := k8s.DynamicClientSet(config)
-	if err != nil {
-		return nil, err
-	}
-	if mapping.Scope.Name() == meta.RESTScopeNameRoot {
-		ri = dyn.Resource(mapping.Resource)
-	} else {
-		ri = dyn.Resource(mapping.Resource).Namespace(namespace)
+// WithTimeout derives the context of a single API server call from ctx.
+func WithTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if OperationTimeout > 0 {
+		return context.WithTimeout(ctx, OperationTimeout)
 	}
-
-	return ri.Create(context.TODO(), resource, metav1.CreateOptions{})
+	return context.WithCancel(ctx)
 }
 
-func UpdateResourceSchema(resource *unstructured.Unstructured, config, namespace string) (*unstructured.Unstructured, error) {
-	cfg, err := clientcmd.BuildConfigFromFlags("", config)
-	if err != nil {
-		return nil, err
-	}
-	dc, err := discovery.NewDiscoveryClientForConfig(cfg)
-	if err != nil {
-		return nil, err
-	}
-	gr, err := restmapper.GetAPIGroupResources(dc)
+// resourceInterface resolves the dynamic client for a kind, scoped to the
+// namespace unless the kind is cluster scoped.
+func resourceInterface(gvk schema.GroupVersionKind, config, namespace string) (dynamic.ResourceInterface, error) {
+	clients, err := k8s.ClientsFor(config)
 	if err != nil {
 		return nil, err
 	}
-	gvk := resource.GetObjectKind().GroupVersionKind()
-	rm := restmapper.NewDiscoveryRESTMapper(gr)
-	mapping, err := rm.RESTMapping(gvk.GroupKind(), gvk.Version)
-	if err != nil {
-		return nil, err
-	}
-
-	var ri dynamic.ResourceInterface
-	dyn, err := k8s.DynamicClientSet(config)
+	mapping, err := clients.RESTMapping(gvk)
 	if err != nil {
 		return nil, err
 	}
 	if mapping.Scope.Name() == meta.RESTScopeNameRoot {
-		ri = dyn.Resource(mapping.Resource)
-	} else {
-		ri = dyn.Resource(mapping.Resource).Namespace(namespace)
+		return clients.Dynamic.Resource(mapping.Resource), nil
 	}
-
-	return ri.Update(context.TODO(), resource, metav1.UpdateOptions{})
+	return clients.Dynamic.Resource(mapping.Resource).Namespace(namespace), nil
 }
 
-func PatchResourceSchema(name, config, namespace string, gvk schema.GroupVersionKind, patchData []byte, patchType types.PatchType) (*unstructured.Unstructured, error) {
-	cfg, err := clientcmd.BuildConfigFromFlags("", config)
-	if err != nil {
-		return nil, err
-	}
-	dc, err := discovery.NewDiscoveryClientForConfig(cfg)
-	if err != nil {
-		return nil, err
-	}
-	gr, err := restmapper.GetAPIGroupResources(dc)
-	if err != nil {
-		return nil, err
-	}
-	rm := restmapper.NewDiscoveryRESTMapper(gr)
-	mapping, err := rm.RESTMapping(gvk.GroupKind(), gvk.Version)
-	if err != nil {
-		return nil, err
-	}
-
-	var ri dynamic.ResourceInterface
-	dyn, err := k8s.DynamicClientSet(config)
+func CreateResourceSchema(ctx context.Context, resource *unstructured.Unstructured, config, namespace string) (*unstructured.Unstructured, error) {
+	ri, err := resourceInterface(resource.GetObjectKind().GroupVersionKind(), config, namespace)
 	if err != nil {
 		return nil, err
 	}
-	if mapping.Scope.Name() == meta.RESTScopeNameRoot {
-		ri = dyn.Resource(mapping.Resource)
-	} else {
-		ri = dyn.Resource(mapping.Resource).Namespace(namespace)
-	}
-
-	return ri.Patch(context.TODO(), name, patchType, patchData, metav1.PatchOptions{})
+	ctx, cancel := WithTimeout(ctx)
+	defer cancel()
+	return ri.Create(ctx, resource, metav1.CreateOptions{})
 }
 
-func GetResourceSchema(gvk schema.GroupVersionKind, name, config, namespace string) (*unstructured.Unstructured, error) {
-	cfg, err := clientcmd.BuildConfigFromFlags("", config)
-	if err != nil {
-		return nil, err
-	}
-	dc, err := discovery.NewDiscoveryClientForConfig(cfg)
-	if err != nil {
-		return nil, err
-	}
-	gr, err := restmapper.GetAPIGroupResources(dc)
-	if err != nil {
-		return nil, err
-	}
-
-	rm := restmapper.NewDiscoveryRESTMapper(gr)
-	mapping, err := rm.RESTMapping(gvk.GroupKind(), gvk.Version)
+func UpdateResourceSchema(ctx context.Context, resource *unstructured.Unstructured, config, namespace string) (*unstructured.Unstructured, error) {
+	ri, err := resourceInterface(resource.GetObjectKind().GroupVersionKind(), config, namespace)
 	if err != nil {
 		return nil, err
 	}
-
-	var ri dynamic.ResourceInterface
-	dyn, err := k8s.DynamicClientSet(config)
-	if err != nil {
-		return nil, err
-	}
-	if mapping.Scope.Name() == meta.RESTScopeNameRoot {
-		ri = dyn.Resource(mapping.Resource)
-	} else {
-		ri = dyn.Resource(mapping.Resource).Namespace(namespace)
-	}
-
-	return ri.Get(context.TODO(), name, metav1.GetOptions{})
+	ctx, cancel := WithTimeout(ctx)
+	defer cancel()
+	return ri.Update(ctx, resource, metav1.UpdateOptions{})
 }
 
-func GetWithSubResourceSchema(gvk schema.GroupVersionKind, name, config, namespace string, subresources ...string) (*unstructured.Unstructured, error) {
-	cfg, err := clientcmd.BuildConfigFromFlags("", config)
-	if err != nil {
-		return nil, err
-	}
-	dc, err := discovery.NewDiscoveryClientForConfig(cfg)
-	if err != nil {
-		return nil, err
-	}
-	gr, err := restmapper.GetAPIGroupResources(dc)
-	if err != nil {
-		return nil, err
-	}
-
-	rm := restmapper.NewDiscoveryRESTMapper(gr)
-	mapping, err := rm.RESTMapping(gvk.GroupKind(), gvk.Version)
-	if err != nil {
-		return nil, err
-	}
-
-	var ri dynamic.ResourceInterface
-	dyn, err := k8s.DynamicClientSet(config)
+func PatchResourceSchema(ctx context.Context, name, config, namespace string, gvk schema.GroupVersionKind, patchData []byte, patchType types.PatchType) (*unstructured.Unstructured, error) {
+	ri, err := resourceInterface(gvk, config, namespace)
 	if err != nil {
 		return nil, err
 	}
-	if mapping.Scope.Name() == meta.RESTScopeNameRoot {
-		ri = dyn.Resource(mapping.Resource)
-	} else {
-		ri = dyn.Resource(mapping.Resource).Namespace(namespace)
-	}
-
-	return ri.Get(context.TODO(), name, metav1.GetOptions{}, subresources...)
+	ctx, cancel := WithTimeout(ctx)
+	defer cancel()
+	return ri.Patch(ctx, name, patchType, patchData, metav1.PatchOptions{})
 }
 
-func ListResourceSchema(gvk schema.GroupVersionKind, config, namespace string) (*unstructured.UnstructuredList, error) {
-	cfg, err := clientcmd.BuildConfigFromFlags("", config)
-	if err != nil {
-		return nil, err
-	}
-	dc, err := discovery.NewDiscoveryClientForConfig(cfg)
-	if err != nil {
-		return nil, err
-	}
-	gr, err := restmapper.GetAPIGroupResources(dc)
+func GetResourceSchema(ctx context.Context, gvk schema.GroupVersionKind, name, config, namespace string) (*unstructured.Unstructured, error) {
+	ri, err := resourceInterface(gvk, config, namespace)
 	if err != nil {
 		return nil, err
 	}
+	ctx, cancel := WithTimeout(ctx)
+	defer cancel()
+	return ri.Get(ctx, name, metav1.GetOptions{})
+}
 
-	rm := restmapper.NewDiscoveryRESTMapper(gr)
-	mapping, err := rm.RESTMapping(gvk.GroupKind(), gvk.Version)
+func GetWithSubResourceSchema(ctx context.Context, gvk schema.GroupVersionKind, name, config, namespace string, subresources ...string) (*unstructured.Unstructured, error) {
+	ri, err := resourceInterface(gvk, config, namespace)
 	if err != nil {
 		return nil, err
 	}
+	ctx, cancel := WithTimeout(ctx)
+	defer cancel()
+	return ri.Get(ctx, name, metav1.GetOptions{}, subresources...)
+}
 
-	var ri dynamic.ResourceInterface
-	dyn, err := k8s.DynamicClientSet(config)
+func ListResourceSchema(ctx context.Context, gvk schema.GroupVersionKind, config, namespace string, opts metav1.ListOptions) (*unstructured.UnstructuredList, error) {
+	ri, err := resourceInterface(gvk, config, namespace)
 	if err != nil {
 		return nil, err
 	}
-	if mapping.Scope.Name() == meta.RESTScopeNameRoot {
-		ri = dyn.Resource(mapping.Resource)
-	} else {
-		ri = dyn.Resource(mapping.Resource).Namespace(namespace)
-	}
-
-	return ri.List(context.TODO(), metav1.ListOptions{})
+	ctx, cancel := WithTimeout(ctx)
+	defer cancel()
+	return ri.List(ctx, opts)
 }
 
-func DeleteResourceSchema(gvk schema.GroupVersionKind, name, config, namespace string) error {
-	cfg, err := clientcmd.BuildConfigFromFlags("", config)
-	if err != nil {
-		return err
-	}
-	dc, err := discovery.NewDiscoveryClientForConfig(cfg)
-	if err != nil {
-		return err
-	}
-	gr, err := restmapper.GetAPIGroupResources(dc)
-	if err != nil {
-		return err
-	}
-
-	rm := restmapper.NewDiscoveryRESTMapper(gr)
-	mapping, err := rm.RESTMapping(gvk.GroupKind(), gvk.Version)
+func DeleteResourceSchema(ctx context.Context, gvk schema.GroupVersionKind, name, config, namespace string) error {
+	ri, err := resourceInterface(gvk, config, namespace)
 	if err != nil {
 		return err
 	}
-
-	var ri dynamic.ResourceInterface
-	dyn, err := k8s.DynamicClientSet(config)
-	if err != nil {
-		return err
-	}
-	if mapping.Scope.Name() == meta.RESTScopeNameRoot {
-		ri = dyn.Resource(mapping.Resource)
-	} else {
-		ri = dyn.Resource(mapping.Resource).Namespace(namespace)
-	}
-
-	return ri.Delete(context.TODO(), name, metav1.DeleteOptions{})
+	ctx, cancel := WithTimeout(ctx)
+	defer cancel()
+	return ri.Delete(ctx, name, metav1.DeleteOptions{})
 }
 
-func WatchResourceSchema(gvk schema.GroupVersionKind, config, namespace string) (watch.Interface, error) {
-	cfg, err := clientcmd.BuildConfigFromFlags("", config)
-	if err != nil {
-		return nil, err
-	}
-	dc, err := discovery.NewDiscoveryClientForConfig(cfg)
+func WatchResourceSchema(ctx context.Context, gvk schema.GroupVersionKind, config, namespace string, opts metav1.ListOptions) (watch.Interface, error) {
+	ri, err := resourceInterface(gvk, config, namespace)
 	if err != nil {
 		return nil, err
 	}
-	gr, err := restmapper.GetAPIGroupResources(dc)
-	if err != nil {
-		return nil, err
-	}
-	rm := restmapper.NewDiscoveryRESTMapper(gr)
-	mapping, err := rm.RESTMapping(gvk.GroupKind(), gvk.Version)
-	if err != nil {
-		return nil, err
-	}
-	var ri dynamic.ResourceInterface
-	dyn, err := k8s.DynamicClientSet(config)
-	if err != nil {
-		return nil, err
-	}
-	if mapping.Scope.Name() == meta.RESTScopeNameRoot {
-		ri = dyn.Resource(mapping.Resource)
-	} else {
-		ri = dyn.Resource(mapping.Resource).Namespace(namespace)
-	}
-	return ri.Watch(context.TODO(), metav1.ListOptions{})
+	return ri.Watch(ctx, opts)
 }
 
 func KubevirtResourceSchema(config string) (kubecli.KubevirtClient, error) {
-	cfg, err := clientcmd.BuildConfigFromFlags("", config)
+	clients, err := k8s.ClientsFor(config)
 	if err != nil {
 		return nil, err
 	}
-	return kubecli.GetKubevirtClientFromRESTConfig(cfg)
+	return clients.Kubevirt, nil
 }
@@ -0,0 +1,124 @@
+package clusters
+
+import (
+	"cloud/internal/clusters/k8s"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+// stalledCluster serves API requests that never answer, reporting each
+// request that the client abandoned.
+func stalledCluster(t *testing.T) <-chan struct{} {
+	t.Helper()
+	abandoned := make(chan struct{}, 8)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A client going away is only noticed once the body has been read.
+		_, _ = io.Copy(io.Discard, r.Body)
+		select {
+		case <-r.Context().Done():
+			abandoned <- struct{}{}
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	t.Cleanup(server.Close)
+	client, err := dynamic.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(testGVK, meta.RESTScopeNamespace)
+	clientsFor := k8s.ClientsFor
+	k8s.ClientsFor = func(string) (*k8s.Clients, error) {
+		return k8s.NewClients(client, testMapper{mapper}), nil
+	}
+	t.Cleanup(func() { k8s.ClientsFor = clientsFor })
+	return abandoned
+}
+
+func TestCallsFollowTheirContext(t *testing.T) {
+	operationTimeout := OperationTimeout
+	defer func() { OperationTimeout = operationTimeout }()
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		cancel  bool
+		err     error
+	}{
+		{"cancelled by the caller", time.Minute, true, context.Canceled},
+		{"operation timeout", 100 * time.Millisecond, false, context.DeadlineExceeded},
+	}
+	calls := map[string]func(ctx context.Context) error{
+		"get": func(ctx context.Context) error {
+			_, err := GetResourceSchema(ctx, testGVK, "web", "test", "p-1")
+			return err
+		},
+		"list": func(ctx context.Context) error {
+			_, err := ListResourceSchema(ctx, testGVK, "test", "p-1", metav1.ListOptions{})
+			return err
+		},
+		"delete": func(ctx context.Context) error {
+			return DeleteResourceSchema(ctx, testGVK, "web", "test", "p-1")
+		},
+	}
+	for _, test := range tests {
+		for call, do := range calls {
+			t.Run(test.name+" "+call, func(t *testing.T) {
+				abandoned := stalledCluster(t)
+				OperationTimeout = test.timeout
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				if test.cancel {
+					time.AfterFunc(100*time.Millisecond, cancel)
+				}
+				start := time.Now()
+				err := do(ctx)
+				if !errors.Is(err, test.err) {
+					t.Errorf("expected %v, got %v", test.err, err)
+				}
+				if elapsed := time.Since(start); elapsed > 2*time.Second {
+					t.Errorf("expected the call to end early, took %v", elapsed)
+				}
+				select {
+				case <-abandoned:
+				case <-time.After(2 * time.Second):
+					t.Error("expected the API server request to be abandoned")
+				}
+			})
+		}
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	operationTimeout := OperationTimeout
+	defer func() { OperationTimeout = operationTimeout }()
+
+	OperationTimeout = 0
+	ctx, cancel := WithTimeout(context.Background())
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("expected no deadline when the timeout is disabled")
+	}
+	cancel()
+	if ctx.Err() == nil {
+		t.Error("expected the context to be cancellable")
+	}
+
+	OperationTimeout = time.Minute
+	parent, cancelParent := context.WithTimeout(context.Background(), time.Second)
+	defer cancelParent()
+	ctx, cancel = WithTimeout(parent)
+	defer cancel()
+	if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > time.Second {
+		t.Errorf("expected the earlier deadline of the caller to hold, got %v", deadline)
+	}
+}
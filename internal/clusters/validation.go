@@ -0,0 +1,201 @@
+package clusters
+
+import (
+	"math"
+	"net/url"
+	"reflect"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// ValidationError carries every problem found with a request payload.
+type ValidationError struct {
+	Errors field.ErrorList
+}
+
+func (e *ValidationError) Error() string {
+	return e.Errors.ToAggregate().Error()
+}
+
+// NewValidationError returns a ValidationError for errs, or nil when there
+// are none.
+func NewValidationError(errs field.ErrorList) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return &ValidationError{Errors: errs}
+}
+
+const (
+	// maxNameLength keeps the names derived from a virtual machine name,
+	// such as its "os-volume-disk-" data volume, within a DNS-1123 label.
+	maxNameLength = validation.DNS1123LabelMaxLength - len("os-volume-disk-")
+	maxVCPU       = 256
+)
+
+// reservedNames clash with the routes under /virtual-machines.
+var reservedNames = []string{"watch"}
+
+// RunStrategies are the run strategies a virtual machine can be created with.
+var RunStrategies = []string{"Always", "Manual", "Halted", "RerunOnFailure"}
+
+// Validate checks a payload for creating a virtual machine.
+func (p ResourceDetails) Validate() field.ErrorList {
+	errs := field.ErrorList{}
+	compute := field.NewPath("compute")
+
+	name := compute.Child("name")
+	switch {
+	case p.Compute.Name == "":
+		errs = append(errs, field.Required(name, ""))
+	case len(p.Compute.Name) > maxNameLength:
+		errs = append(errs, field.TooLong(name, p.Compute.Name, maxNameLength))
+	default:
+		for _, msg := range validation.IsDNS1123Label(p.Compute.Name) {
+			errs = append(errs, field.Invalid(name, p.Compute.Name, msg))
+		}
+		for _, reserved := range reservedNames {
+			if p.Compute.Name == reserved {
+				errs = append(errs, field.Forbidden(name, "\""+reserved+"\" is a reserved name"))
+			}
+		}
+	}
+
+	if p.Compute.CPU == 0 {
+		errs = append(errs, field.Required(compute.Child("vcpu"), ""))
+	}
+	errs = append(errs, validateVCPU(compute.Child("vcpu"), p.Compute.CPU)...)
+	if p.Compute.RAM == "" {
+		errs = append(errs, field.Required(compute.Child("ram"), ""))
+	}
+	errs = append(errs, validateQuantity(compute.Child("ram"), p.Compute.RAM)...)
+	if p.Compute.Storage == "" {
+		errs = append(errs, field.Required(compute.Child("storage"), ""))
+	}
+	errs = append(errs, validateQuantity(compute.Child("storage"), p.Compute.Storage)...)
+
+	imageURL := compute.Child("url")
+	if p.Compute.URL == "" {
+		errs = append(errs, field.Required(imageURL, ""))
+	} else if u, err := url.Parse(p.Compute.URL); err != nil {
+		errs = append(errs, field.Invalid(imageURL, p.Compute.URL, err.Error()))
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		errs = append(errs, field.NotSupported(imageURL.Key("scheme"), u.Scheme, []string{"http", "https"}))
+	} else if u.Host == "" {
+		errs = append(errs, field.Invalid(imageURL, p.Compute.URL, "must include a host"))
+	}
+
+	if p.Compute.RunStrategy != "" && !contains(RunStrategies, p.Compute.RunStrategy) {
+		errs = append(errs, field.NotSupported(compute.Child("run_strategy"), p.Compute.RunStrategy, RunStrategies))
+	}
+
+	datasource := field.NewPath("cloud_init", "datasource")
+	if p.CloudInit.Datasource != "" && !contains([]string{"nocloud", "configdrive"}, p.CloudInit.Datasource) {
+		errs = append(errs, field.NotSupported(datasource, p.CloudInit.Datasource, []string{"nocloud", "configdrive"}))
+	}
+	if p.UserData != nil {
+		errs = append(errs, p.UserData.validate(field.NewPath("user_data"), []string{"merge", "replace"})...)
+	}
+	if p.NetworkData != nil {
+		errs = append(errs, p.NetworkData.validate(field.NewPath("network_data"), nil)...)
+	}
+	return errs
+}
+
+// ValidateUpdate checks a payload for updating a virtual machine, where
+// every field is optional. Only the vCPUs, memory, storage and SSH keys of
+// a virtual machine can be updated, any other field is rejected rather than
+// silently ignored.
+func (p ResourceDetails) ValidateUpdate() field.ErrorList {
+	compute := field.NewPath("compute")
+	errs := validateVCPU(compute.Child("vcpu"), p.Compute.CPU)
+	errs = append(errs, validateQuantity(compute.Child("ram"), p.Compute.RAM)...)
+	errs = append(errs, validateQuantity(compute.Child("storage"), p.Compute.Storage)...)
+	unsupported := []struct {
+		path *field.Path
+		set  bool
+	}{
+		{compute.Child("name"), p.Compute.Name != ""},
+		{compute.Child("url"), p.Compute.URL != ""},
+		{compute.Child("instances"), p.Compute.Instances != 0},
+		{compute.Child("state"), p.Compute.State != ""},
+		{compute.Child("run_strategy"), p.Compute.RunStrategy != ""},
+		{compute.Child("containers"), len(p.Compute.Container) > 0},
+		{field.NewPath("user"), !reflect.ValueOf(p.User).IsZero()},
+		{field.NewPath("cloud_init"), !reflect.ValueOf(p.CloudInit).IsZero()},
+		{field.NewPath("user_data"), p.UserData != nil},
+		{field.NewPath("network_data"), p.NetworkData != nil},
+	}
+	for _, u := range unsupported {
+		if u.set {
+			errs = append(errs, field.Forbidden(u.path, "cannot be updated"))
+		}
+	}
+	return errs
+}
+
+// ReplacesUserData reports whether the raw user data replaces the generated
+// cloud-init config rather than being merged into it.
+func (p ResourceDetails) ReplacesUserData() bool {
+	return p.UserData != nil && p.UserData.Mode == "replace"
+}
+
+func (d CloudInitData) validate(path *field.Path, modes []string) field.ErrorList {
+	errs := field.ErrorList{}
+	if d.Inline != "" && d.Secret != "" {
+		errs = append(errs, field.Invalid(path, d.Secret, "accepts either inline or secret, not both"))
+	}
+	if d.Secret != "" {
+		for _, msg := range validation.IsDNS1123Subdomain(d.Secret) {
+			errs = append(errs, field.Invalid(path.Child("secret"), d.Secret, msg))
+		}
+	}
+	switch {
+	case d.Mode == "":
+	case len(modes) == 0:
+		errs = append(errs, field.Forbidden(path.Child("mode"), "is not supported, the data is always used as is"))
+	case !contains(modes, d.Mode):
+		errs = append(errs, field.NotSupported(path.Child("mode"), d.Mode, modes))
+	}
+	if (d.Mode == "replace" || len(modes) == 0) && d.Inline == "" && d.Secret == "" {
+		errs = append(errs, field.Required(path, "inline or secret is required"))
+	}
+	return errs
+}
+
+func validateVCPU(path *field.Path, cpu float64) field.ErrorList {
+	switch {
+	case cpu < 0:
+		return field.ErrorList{field.Invalid(path, cpu, "must be positive")}
+	case cpu != math.Trunc(cpu):
+		return field.ErrorList{field.Invalid(path, cpu, "must be a whole number")}
+	case cpu > maxVCPU:
+		return field.ErrorList{field.Invalid(path, cpu, "must not exceed 256")}
+	}
+	return nil
+}
+
+func validateQuantity(path *field.Path, value string) field.ErrorList {
+	if value == "" {
+		return nil
+	}
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil {
+		return field.ErrorList{field.Invalid(path, value, "must be a quantity such as 2Gi")}
+	}
+	if quantity.Sign() <= 0 {
+		return field.ErrorList{field.Invalid(path, value, "must be greater than zero")}
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
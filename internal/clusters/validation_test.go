@@ -0,0 +1,83 @@
+package clusters
+
+import (
+	"testing"
+)
+
+func TestValidateCollectsAllFieldErrors(t *testing.T) {
+	payload := ResourceDetails{
+		Compute: Compute{
+			Name:    "watch",
+			CPU:     -2,
+			RAM:     "lots",
+			Storage: "20Gi",
+			URL:     "ftp://images.example.com/focal.img",
+		},
+	}
+	errs := payload.Validate()
+	fields := map[string]bool{}
+	for _, err := range errs {
+		fields[err.Field] = true
+	}
+	for _, field := range []string{"compute.name", "compute.vcpu", "compute.ram", "compute.url[scheme]"} {
+		if !fields[field] {
+			t.Errorf("expected an error for %s, got %v", field, errs)
+		}
+	}
+	if fields["compute.storage"] {
+		t.Errorf("did not expect an error for compute.storage, got %v", errs)
+	}
+}
+
+func TestValidateAcceptsCompletePayload(t *testing.T) {
+	payload := ResourceDetails{
+		Compute: Compute{
+			Name:        "web-01",
+			CPU:         2,
+			RAM:         "2Gi",
+			Storage:     "20Gi",
+			URL:         "https://cloud-images.ubuntu.com/focal.img",
+			RunStrategy: "Halted",
+		},
+		UserData: &CloudInitData{Secret: "web-userdata", Mode: "replace"},
+	}
+	if errs := payload.Validate(); len(errs) != 0 {
+		t.Errorf("expected no errors, got %v", errs)
+	}
+	if errs := (ResourceDetails{Compute: Compute{CPU: 1.5, RAM: "0"}}).ValidateUpdate(); len(errs) != 2 {
+		t.Errorf("expected 2 update errors, got %v", errs)
+	}
+}
+
+func TestValidateUpdateRejectsUnsupportedFields(t *testing.T) {
+	payload := ResourceDetails{
+		Compute: Compute{Name: "web", URL: "https://images.example.com/focal.img", SSHKey: "ssh-ed25519 AAAA arthur"},
+		User:    User{Name: "arthur"},
+	}
+	fields := map[string]bool{}
+	for _, err := range payload.ValidateUpdate() {
+		fields[err.Field] = true
+	}
+	if len(fields) != 3 || !fields["compute.name"] || !fields["compute.url"] || !fields["user"] {
+		t.Errorf("expected compute.name, compute.url and user to be rejected, got %v", fields)
+	}
+}
+
+func TestValidateRunStrategy(t *testing.T) {
+	for strategy, valid := range map[string]bool{
+		"":               true,
+		"Halted":         true,
+		"RerunOnFailure": true,
+		"Sometimes":      false,
+		"halted":         false,
+	} {
+		payload := ResourceDetails{Compute: Compute{RunStrategy: strategy}}
+		rejected := false
+		for _, err := range payload.Validate() {
+			rejected = rejected || err.Field == "compute.run_strategy"
+		}
+		if rejected == valid {
+			t.Errorf("run strategy %q: expected valid %v, got errors %v", strategy, valid, payload.Validate())
+		}
+	}
+}
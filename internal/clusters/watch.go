@@ -0,0 +1,271 @@
+package clusters
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// watchRetryMin and watchRetryMax bound the delay before reopening a watch
+// that closed without delivering any event.
+var (
+	watchRetryMin = time.Second
+	watchRetryMax = 30 * time.Second
+)
+
+// watchOutcome describes why a single watch request came to an end.
+type watchOutcome int
+
+const (
+	watchClosed watchOutcome = iota
+	watchExpired
+	watchFailed
+	watchStopped
+)
+
+// resumableWatcher is a watch.Interface that transparently re-establishes
+// its underlying watch from the last seen resource version, and re-lists
+// when that version has been compacted away by the API server.
+type resumableWatcher struct {
+	ctx             context.Context
+	gvk             schema.GroupVersionKind
+	config          string
+	namespace       string
+	resourceVersion string
+	// known maps the name of every object delivered so far to its resource
+	// version, so a re-list only emits what actually changed. It is only
+	// complete, and a re-list only able to report deletions, when the watch
+	// started from the current state rather than a client resource version.
+	known    map[string]string
+	complete bool
+	result   chan watch.Event
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// ResumeWatchResourceSchema watches resources of the given kind starting
+// after resourceVersion, or from the current state when it is empty.
+// Bookmarks are requested and forwarded so clients can record progress and
+// resume a dropped stream by passing the last resource version they saw.
+// When that version has expired the watch ends with an Expired error event,
+// as the client then has to list again to learn about deletions it missed.
+// The watch ends when ctx is done.
+func ResumeWatchResourceSchema(ctx context.Context, gvk schema.GroupVersionKind, config, namespace, resourceVersion string) (watch.Interface, error) {
+	w := &resumableWatcher{
+		ctx:             ctx,
+		gvk:             gvk,
+		config:          config,
+		namespace:       namespace,
+		resourceVersion: resourceVersion,
+		known:           map[string]string{},
+		complete:        resourceVersion == "",
+		result:          make(chan watch.Event),
+		done:            make(chan struct{}),
+	}
+	// The first request is made synchronously so that configuration and
+	// permission problems are reported to the caller.
+	inner, err := w.open()
+	if err != nil && !isExpired(err) {
+		return nil, err
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			w.Stop()
+		case <-w.done:
+		}
+	}()
+	go w.run(inner)
+	return w, nil
+}
+
+func (w *resumableWatcher) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.done)
+	})
+}
+
+func (w *resumableWatcher) ResultChan() <-chan watch.Event {
+	return w.result
+}
+
+func (w *resumableWatcher) open() (watch.Interface, error) {
+	return WatchResourceSchema(w.ctx, w.gvk, w.config, w.namespace, metav1.ListOptions{
+		ResourceVersion:     w.resourceVersion,
+		AllowWatchBookmarks: true,
+	})
+}
+
+func (w *resumableWatcher) run(inner watch.Interface) {
+	defer close(w.result)
+	var delay time.Duration
+	for {
+		outcome, delivered := watchExpired, false
+		if inner != nil {
+			outcome, delivered = w.consume(inner)
+		}
+		switch outcome {
+		case watchStopped, watchFailed:
+			return
+		case watchExpired:
+			if !w.complete {
+				// The client holds objects this watcher never delivered,
+				// whose deletion a re-list cannot tell it about, so it has
+				// to list again itself.
+				w.sendError(errors.NewResourceExpired("resource version " + w.resourceVersion + " is too old, list again"))
+				return
+			}
+			if err := w.relist(); err != nil {
+				w.sendError(err)
+				return
+			}
+			delay = 0
+		case watchClosed:
+			// Watches that keep closing without delivering anything are
+			// reopened less and less often.
+			if delivered {
+				delay = 0
+			} else {
+				delay = min(max(2*delay, watchRetryMin), watchRetryMax)
+			}
+			if !w.sleep(delay) {
+				return
+			}
+		}
+		var err error
+		inner, err = w.open()
+		if err != nil && !isExpired(err) {
+			w.sendError(err)
+			return
+		}
+	}
+}
+
+// sleep waits for d unless the watcher is stopped first.
+func (w *resumableWatcher) sleep(d time.Duration) bool {
+	if d == 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-w.done:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// consume forwards the events of a single watch request until it ends,
+// reporting whether any event was delivered.
+func (w *resumableWatcher) consume(inner watch.Interface) (watchOutcome, bool) {
+	defer inner.Stop()
+	delivered := false
+	for {
+		select {
+		case <-w.done:
+			return watchStopped, delivered
+		case event, ok := <-inner.ResultChan():
+			if !ok {
+				return watchClosed, delivered
+			}
+			if event.Type == watch.Error {
+				err := errors.FromObject(event.Object)
+				if isExpired(err) {
+					return watchExpired, delivered
+				}
+				w.send(event)
+				return watchFailed, delivered
+			}
+			obj, ok := event.Object.(*unstructured.Unstructured)
+			if ok {
+				w.resourceVersion = obj.GetResourceVersion()
+				switch event.Type {
+				case watch.Added, watch.Modified:
+					w.known[obj.GetName()] = obj.GetResourceVersion()
+				case watch.Deleted:
+					delete(w.known, obj.GetName())
+				}
+			}
+			if !w.send(event) {
+				return watchStopped, delivered
+			}
+			delivered = true
+		}
+	}
+}
+
+// relist brings the client up to date after its resource version expired,
+// emitting events only for objects that differ from what was delivered, and
+// closes with a bookmark at the resource version of the list.
+func (w *resumableWatcher) relist() error {
+	list, err := ListResourceSchema(w.ctx, w.gvk, w.config, w.namespace, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for i := range list.Items {
+		item := &list.Items[i]
+		name := item.GetName()
+		seen[name] = true
+		rv, ok := w.known[name]
+		if ok && rv == item.GetResourceVersion() {
+			continue
+		}
+		eventType := watch.Added
+		if ok {
+			eventType = watch.Modified
+		}
+		w.known[name] = item.GetResourceVersion()
+		if !w.send(watch.Event{Type: eventType, Object: item}) {
+			return nil
+		}
+	}
+	for name := range w.known {
+		if seen[name] {
+			continue
+		}
+		delete(w.known, name)
+		gone := &unstructured.Unstructured{}
+		gone.SetGroupVersionKind(w.gvk)
+		gone.SetName(name)
+		gone.SetNamespace(w.namespace)
+		if !w.send(watch.Event{Type: watch.Deleted, Object: gone}) {
+			return nil
+		}
+	}
+	w.resourceVersion = list.GetResourceVersion()
+	bookmark := &unstructured.Unstructured{}
+	bookmark.SetGroupVersionKind(w.gvk)
+	bookmark.SetResourceVersion(w.resourceVersion)
+	w.send(watch.Event{Type: watch.Bookmark, Object: bookmark})
+	return nil
+}
+
+// send delivers an event unless the watcher has been stopped.
+func (w *resumableWatcher) send(event watch.Event) bool {
+	select {
+	case <-w.done:
+		return false
+	case w.result <- event:
+		return true
+	}
+}
+
+func (w *resumableWatcher) sendError(err error) {
+	status := errors.NewInternalError(err).Status()
+	if statusErr, ok := err.(errors.APIStatus); ok {
+		status = statusErr.Status()
+	}
+	w.send(watch.Event{Type: watch.Error, Object: &status})
+}
+
+func isExpired(err error) bool {
+	return errors.IsResourceExpired(err) || errors.IsGone(err)
+}
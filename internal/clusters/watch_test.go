@@ -0,0 +1,252 @@
+package clusters
+
+import (
+	"cloud/internal/clusters/k8s"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var (
+	testGVK = schema.GroupVersionKind{Group: "kubevirt.io", Version: "v1", Kind: "VirtualMachine"}
+	testGVR = schema.GroupVersionResource{Group: "kubevirt.io", Version: "v1", Resource: "virtualmachines"}
+)
+
+// testMapper maps the kind watched in tests.
+type testMapper struct {
+	*meta.DefaultRESTMapper
+}
+
+func (testMapper) Reset() {}
+
+// fakeCluster serves the watch requests of a test from a queue of watchers,
+// recording the resource version each request was made from.
+type fakeCluster struct {
+	mu       sync.Mutex
+	watchers []watch.Interface
+	watchErr error
+	versions []string
+	opened   []time.Time
+	list     *unstructured.UnstructuredList
+}
+
+func newFakeCluster(t *testing.T) *fakeCluster {
+	t.Helper()
+	cluster := &fakeCluster{}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		testGVR: "VirtualMachineList",
+	})
+	client.PrependWatchReactor("virtualmachines", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		cluster.mu.Lock()
+		defer cluster.mu.Unlock()
+		cluster.versions = append(cluster.versions, action.(k8stesting.WatchAction).GetWatchRestrictions().ResourceVersion)
+		cluster.opened = append(cluster.opened, time.Now())
+		if cluster.watchErr != nil {
+			err := cluster.watchErr
+			cluster.watchErr = nil
+			return true, nil, err
+		}
+		if len(cluster.watchers) == 0 {
+			// Further requests block until the test ends.
+			return true, watch.NewFake(), nil
+		}
+		next := cluster.watchers[0]
+		cluster.watchers = cluster.watchers[1:]
+		return true, next, nil
+	})
+	client.PrependReactor("list", "virtualmachines", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		cluster.mu.Lock()
+		defer cluster.mu.Unlock()
+		return true, cluster.list, nil
+	})
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(testGVK, meta.RESTScopeNamespace)
+	clientsFor := k8s.ClientsFor
+	k8s.ClientsFor = func(string) (*k8s.Clients, error) {
+		return k8s.NewClients(client, testMapper{mapper}), nil
+	}
+	t.Cleanup(func() { k8s.ClientsFor = clientsFor })
+	return cluster
+}
+
+// closedWatcher returns a watcher that delivers events and then closes, as
+// the API server does when a watch times out.
+func closedWatcher(events ...watch.Event) watch.Interface {
+	w := watch.NewFakeWithChanSize(len(events), false)
+	for _, event := range events {
+		w.Action(event.Type, event.Object)
+	}
+	w.Stop()
+	return w
+}
+
+func testObject(name, resourceVersion string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(testGVK)
+	obj.SetName(name)
+	obj.SetNamespace("p-1")
+	obj.SetResourceVersion(resourceVersion)
+	return obj
+}
+
+func expiredEvent() watch.Event {
+	status := errors.NewResourceExpired("too old").Status()
+	return watch.Event{Type: watch.Error, Object: &status}
+}
+
+// receive reads the next n events of a watch.
+func receive(t *testing.T, w watch.Interface, n int) []watch.Event {
+	t.Helper()
+	events := []watch.Event{}
+	for len(events) < n {
+		select {
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				t.Fatalf("watch closed after %d events, expected %d", len(events), n)
+			}
+			events = append(events, event)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out after %d events, expected %d", len(events), n)
+		}
+	}
+	return events
+}
+
+func describe(event watch.Event) string {
+	if obj, ok := event.Object.(*unstructured.Unstructured); ok {
+		return string(event.Type) + " " + obj.GetName() + "@" + obj.GetResourceVersion()
+	}
+	return string(event.Type)
+}
+
+func TestResumeWatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		from     string
+		watchers []watch.Interface
+		watchErr error
+		list     *unstructured.UnstructuredList
+		events   []string
+		versions []string
+	}{
+		{
+			name: "resumes from the last resource version",
+			from: "5",
+			watchers: []watch.Interface{
+				closedWatcher(watch.Event{Type: watch.Added, Object: testObject("web", "6")}),
+				closedWatcher(watch.Event{Type: watch.Modified, Object: testObject("web", "7")}),
+			},
+			events:   []string{"ADDED web@6", "MODIFIED web@7"},
+			versions: []string{"5", "6", "7"},
+		},
+		{
+			name: "relists after expiry",
+			watchers: []watch.Interface{
+				closedWatcher(
+					watch.Event{Type: watch.Added, Object: testObject("web", "1")},
+					watch.Event{Type: watch.Added, Object: testObject("db", "2")},
+					expiredEvent(),
+				),
+			},
+			list: func() *unstructured.UnstructuredList {
+				list := &unstructured.UnstructuredList{}
+				list.SetResourceVersion("10")
+				list.Items = []unstructured.Unstructured{*testObject("web", "3"), *testObject("cache", "4")}
+				return list
+			}(),
+			events:   []string{"ADDED web@1", "ADDED db@2", "MODIFIED web@3", "ADDED cache@4", "DELETED db@", "BOOKMARK @10"},
+			versions: []string{"", "10"},
+		},
+		{
+			name:     "rejects an expired client resource version",
+			from:     "5",
+			watchErr: errors.NewResourceExpired("too old"),
+			events:   []string{"ERROR"},
+			versions: []string{"5"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cluster := newFakeCluster(t)
+			cluster.watchers, cluster.watchErr, cluster.list = test.watchers, test.watchErr, test.list
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			w, err := ResumeWatchResourceSchema(ctx, testGVK, "test", "p-1", test.from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Stop()
+			for i, event := range receive(t, w, len(test.events)) {
+				if got := describe(event); got != test.events[i] {
+					t.Errorf("event %d: expected %s, got %s", i, test.events[i], got)
+				}
+				if event.Type == watch.Error && !errors.IsResourceExpired(errors.FromObject(event.Object)) {
+					t.Errorf("expected an expired error, got %v", event.Object)
+				}
+			}
+			// Wait for the watch to be reopened before checking where from.
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				cluster.mu.Lock()
+				versions := append([]string{}, cluster.versions...)
+				cluster.mu.Unlock()
+				if len(versions) >= len(test.versions) || time.Now().After(deadline) {
+					for i := range test.versions {
+						if i >= len(versions) || versions[i] != test.versions[i] {
+							t.Errorf("expected watches from %v, got %v", test.versions, versions)
+							break
+						}
+					}
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestResumeWatchBacksOffWatchesClosingAtOnce(t *testing.T) {
+	retryMin := watchRetryMin
+	watchRetryMin = 20 * time.Millisecond
+	defer func() { watchRetryMin = retryMin }()
+
+	cluster := newFakeCluster(t)
+	cluster.watchers = []watch.Interface{closedWatcher(), closedWatcher(), closedWatcher()}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w, err := ResumeWatchResourceSchema(ctx, testGVK, "test", "p-1", "5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cluster.mu.Lock()
+		opened := append([]time.Time{}, cluster.opened...)
+		cluster.mu.Unlock()
+		if len(opened) == 4 {
+			if gap := opened[2].Sub(opened[1]); gap < 2*watchRetryMin {
+				t.Errorf("expected the delay to double, got %v after %v", gap, opened[1].Sub(opened[0]))
+			}
+			if gap := opened[1].Sub(opened[0]); gap < watchRetryMin {
+				t.Errorf("expected a delay of at least %v, got %v", watchRetryMin, gap)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 4 watch requests, got %d", len(opened))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,328 @@
+package project
+
+import (
+	"cloud/internal/clusters"
+	"cloud/internal/clusters/k8s"
+	"context"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+const (
+	// ManagedLabel marks the namespaces that are projects.
+	ManagedLabel = "anvil.io/project"
+	// OwnerAnnotation holds the email address of the project owner.
+	OwnerAnnotation = "anvil.io/owner"
+	// MembersAnnotation holds the members of a project as a JSON object
+	// mapping an email address or token subject to a role.
+	MembersAnnotation = "anvil.io/members"
+	// VCPUAnnotation holds the vCPU cap of the project quota. It is kept
+	// apart from the hard limits as vCPUs are overcommitted and do not match
+	// the CPU requests of the pods running them.
+	VCPUAnnotation = "anvil.io/vcpu"
+
+	// defaultObjectName names the quota, limit range and network policy
+	// every project is created with.
+	defaultObjectName = "anvil-default"
+)
+
+// Name derives the namespace of the project owned by an email address.
+func Name(email string) string {
+	normalizedEmail := strings.ToLower(strings.TrimSpace(email))
+	hasher := sha256.New()
+	hasher.Write([]byte(normalizedEmail))
+	hash := hasher.Sum(nil)
+	// Base32 encoding is case-insensitive and safe for DNS names.
+	encoded := base32.StdEncoding.EncodeToString(hash)
+	// Shorten the encoded string and convert to lowercase.
+	shortened := strings.ToLower(encoded[:20])
+	// Add a consistent prefix or suffix for clarity (important!)
+	return fmt.Sprintf("swift-%s", shortened)
+}
+
+// Quota are the resource caps of a project. The vCPU cap is not known to
+// the cluster and only applies to virtual machines created through the API.
+type Quota struct {
+	VCPU    int64  `json:"vcpu,omitempty"`
+	Memory  string `json:"memory,omitempty"`
+	Storage string `json:"storage,omitempty"`
+	VMs     int64  `json:"vms,omitempty"`
+}
+
+// Info is the representation of a project returned to clients.
+type Info struct {
+	Name    string            `json:"name"`
+	Owner   string            `json:"owner"`
+	Members map[string]string `json:"members,omitempty"`
+	Phase   string            `json:"phase"`
+	Created time.Time         `json:"created"`
+}
+
+// NewInfo describes a project namespace.
+func NewInfo(namespace *corev1.Namespace) *Info {
+	return &Info{
+		Name:    namespace.Name,
+		Owner:   namespace.Annotations[OwnerAnnotation],
+		Members: Members(namespace),
+		Phase:   string(namespace.Status.Phase),
+		Created: namespace.CreationTimestamp.Time,
+	}
+}
+
+// Members returns the raw members annotation of a project, ignoring it when
+// it is malformed.
+func Members(namespace *corev1.Namespace) map[string]string {
+	members := map[string]string{}
+	_ = json.Unmarshal([]byte(namespace.Annotations[MembersAnnotation]), &members)
+	return members
+}
+
+type Project struct {
+	ctx        context.Context
+	kubeconfig string
+	project    string
+	request    *http.Request
+}
+
+func NewCluster(req clusters.Resource) *Project {
+	return &Project{
+		ctx:        req.Ctx,
+		kubeconfig: req.Kubeconfig,
+		project:    req.Project,
+		request:    req.Request,
+	}
+}
+
+// Create provisions the project of owner along with its default quota,
+// limit range and network policy. It is idempotent, reporting through the
+// boolean whether the project namespace had to be created.
+func (p *Project) Create(owner string, quota Quota) (*corev1.Namespace, bool, error) {
+	clientSet, err := k8s.ClientSet(p.kubeconfig)
+	if err != nil {
+		return nil, false, err
+	}
+	ctx, cancel := clusters.WithTimeout(p.ctx)
+	defer cancel()
+
+	name := Name(owner)
+	namespace := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				ManagedLabel: "true",
+			},
+			Annotations: map[string]string{
+				OwnerAnnotation: strings.ToLower(strings.TrimSpace(owner)),
+			},
+		},
+	}
+	created := true
+	namespace, err = clientSet.CoreV1().Namespaces().Create(ctx, namespace, metav1.CreateOptions{})
+	if k8serrors.IsAlreadyExists(err) {
+		created = false
+		namespace, err = clientSet.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+		if err == nil && namespace.Labels[ManagedLabel] != "true" {
+			err = k8serrors.NewConflict(corev1.Resource("namespaces"), name, fmt.Errorf("namespace exists but is not a project"))
+		}
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	resourceQuota, err := NewResourceQuota(name, quota)
+	if err != nil {
+		return nil, false, err
+	}
+	_, err = clientSet.CoreV1().ResourceQuotas(name).Create(ctx, resourceQuota, metav1.CreateOptions{})
+	if err != nil && !k8serrors.IsAlreadyExists(err) {
+		return nil, false, err
+	}
+	_, err = clientSet.CoreV1().LimitRanges(name).Create(ctx, defaultLimitRange(name), metav1.CreateOptions{})
+	if err != nil && !k8serrors.IsAlreadyExists(err) {
+		return nil, false, err
+	}
+	_, err = clientSet.NetworkingV1().NetworkPolicies(name).Create(ctx, defaultNetworkPolicy(name), metav1.CreateOptions{})
+	if err != nil && !k8serrors.IsAlreadyExists(err) {
+		return nil, false, err
+	}
+	return namespace, created, nil
+}
+
+// Find gets the project named in the request path.
+func (p *Project) Find() (*corev1.Namespace, error) {
+	name := mux.Vars(p.request)["project"]
+	clientSet, err := k8s.ClientSet(p.kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := clusters.WithTimeout(p.ctx)
+	defer cancel()
+	namespace, err := clientSet.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if namespace.Labels[ManagedLabel] != "true" {
+		return nil, k8serrors.NewNotFound(corev1.Resource("projects"), name)
+	}
+	return namespace, nil
+}
+
+// FindAll lists every project.
+func (p *Project) FindAll() ([]corev1.Namespace, error) {
+	clientSet, err := k8s.ClientSet(p.kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := clusters.WithTimeout(p.ctx)
+	defer cancel()
+	namespaces, err := clientSet.CoreV1().Namespaces().List(ctx, metav1.ListOptions{
+		LabelSelector: ManagedLabel + "=true",
+	})
+	if err != nil {
+		return nil, err
+	}
+	return namespaces.Items, nil
+}
+
+// Delete removes the project named in the request path, along with every
+// resource in it.
+func (p *Project) Delete() error {
+	namespace, err := p.Find()
+	if err != nil {
+		return err
+	}
+	clientSet, err := k8s.ClientSet(p.kubeconfig)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := clusters.WithTimeout(p.ctx)
+	defer cancel()
+	return clientSet.CoreV1().Namespaces().Delete(ctx, namespace.Name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &namespace.UID},
+	})
+}
+
+// NewResourceQuota builds the quota object enforcing a project quota. Zero
+// values leave the matching resource uncapped.
+// Validate checks that the caps of a quota are non-negative.
+func (q Quota) Validate() field.ErrorList {
+	errs := field.ErrorList{}
+	counts := []struct {
+		name  string
+		value int64
+	}{{"vcpu", q.VCPU}, {"vms", q.VMs}}
+	for _, c := range counts {
+		if c.value < 0 {
+			errs = append(errs, field.Invalid(field.NewPath(c.name), c.value, "must not be negative"))
+		}
+	}
+	quantities := []struct {
+		name  string
+		value string
+	}{{"memory", q.Memory}, {"storage", q.Storage}}
+	for _, c := range quantities {
+		if c.value == "" {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(c.value)
+		if err != nil {
+			errs = append(errs, field.Invalid(field.NewPath(c.name), c.value, err.Error()))
+		} else if quantity.Sign() < 0 {
+			errs = append(errs, field.Invalid(field.NewPath(c.name), c.value, "must not be negative"))
+		}
+	}
+	return errs
+}
+
+func NewResourceQuota(namespace string, quota Quota) (*corev1.ResourceQuota, error) {
+	hard := corev1.ResourceList{}
+	if quota.Memory != "" {
+		memory, err := resource.ParseQuantity(quota.Memory)
+		if err != nil {
+			return nil, k8serrors.NewBadRequest("invalid memory quota: " + err.Error())
+		}
+		hard[corev1.ResourceRequestsMemory] = memory
+	}
+	if quota.Storage != "" {
+		storage, err := resource.ParseQuantity(quota.Storage)
+		if err != nil {
+			return nil, k8serrors.NewBadRequest("invalid storage quota: " + err.Error())
+		}
+		hard[corev1.ResourceRequestsStorage] = storage
+	}
+	if quota.VMs > 0 {
+		hard[vmCountResource] = *resource.NewQuantity(quota.VMs, resource.DecimalSI)
+	}
+	resourceQuota := &corev1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        defaultObjectName,
+			Namespace:   namespace,
+			Annotations: map[string]string{},
+		},
+		Spec: corev1.ResourceQuotaSpec{Hard: hard},
+	}
+	if quota.VCPU > 0 {
+		resourceQuota.Annotations[VCPUAnnotation] = strconv.FormatInt(quota.VCPU, 10)
+	}
+	return resourceQuota, nil
+}
+
+// vmCountResource caps the number of virtual machines of a project.
+const vmCountResource corev1.ResourceName = "count/virtualmachines.kubevirt.io"
+
+// defaultLimitRange gives containers that do not ask for resources a small
+// request, so they are accounted for by the project quota.
+func defaultLimitRange(namespace string) *corev1.LimitRange {
+	return &corev1.LimitRange{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      defaultObjectName,
+			Namespace: namespace,
+		},
+		Spec: corev1.LimitRangeSpec{
+			Limits: []corev1.LimitRangeItem{
+				{
+					Type: corev1.LimitTypeContainer,
+					DefaultRequest: corev1.ResourceList{
+						corev1.ResourceCPU:    resource.MustParse("100m"),
+						corev1.ResourceMemory: resource.MustParse("128Mi"),
+					},
+				},
+			},
+		},
+	}
+}
+
+// defaultNetworkPolicy only admits traffic from within the project.
+func defaultNetworkPolicy(namespace string) *networkingv1.NetworkPolicy {
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      defaultObjectName,
+			Namespace: namespace,
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{
+				{
+					From: []networkingv1.NetworkPolicyPeer{
+						{PodSelector: &metav1.LabelSelector{}},
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,100 @@
+package project
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestName(t *testing.T) {
+	name := Name(" Arthur@Example.com ")
+	if name != Name("arthur@example.com") {
+		t.Error("expected names to ignore case and surrounding whitespace")
+	}
+	if len(name) != len("swift-")+20 || name[:6] != "swift-" {
+		t.Errorf("unexpected name %q", name)
+	}
+}
+
+func TestNewResourceQuota(t *testing.T) {
+	quota, err := NewResourceQuota("swift-abc", Quota{VCPU: 8, Memory: "16Gi", VMs: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quota.Annotations[VCPUAnnotation] != "8" {
+		t.Errorf("expected the vCPU cap in the annotations, got %v", quota.Annotations)
+	}
+	memory := quota.Spec.Hard[corev1.ResourceRequestsMemory]
+	vms := quota.Spec.Hard[vmCountResource]
+	if memory.String() != "16Gi" || vms.Value() != 4 {
+		t.Errorf("unexpected hard limits %v", quota.Spec.Hard)
+	}
+	if _, ok := quota.Spec.Hard[corev1.ResourceRequestsStorage]; ok {
+		t.Error("expected an empty storage quota to leave storage uncapped")
+	}
+	if _, err := NewResourceQuota("swift-abc", Quota{Memory: "lots"}); err == nil {
+		t.Error("expected an invalid quantity to fail")
+	}
+}
+
+func TestQuotaValidate(t *testing.T) {
+	tests := []struct {
+		quota  Quota
+		fields []string
+	}{
+		{Quota{VCPU: 8, Memory: "16Gi", Storage: "1Ti", VMs: 4}, nil},
+		{Quota{}, nil},
+		{Quota{VCPU: -1, VMs: -2}, []string{"vcpu", "vms"}},
+		{Quota{Memory: "-1Gi", Storage: "lots"}, []string{"memory", "storage"}},
+	}
+	for _, test := range tests {
+		errs := test.quota.Validate()
+		fields := []string{}
+		for _, err := range errs {
+			fields = append(fields, err.Field)
+		}
+		if strings.Join(fields, ",") != strings.Join(test.fields, ",") {
+			t.Errorf("Validate(%+v) reported %v; want %v", test.quota, fields, test.fields)
+		}
+	}
+}
+
+func TestUsageAdmit(t *testing.T) {
+	usage := &Usage{
+		Limits: Quota{VCPU: 8, Memory: "16Gi", VMs: 4},
+		Used:   Quota{VCPU: 6, Memory: "8Gi", VMs: 2},
+	}
+	if err := usage.admit(Quota{VCPU: 2, Memory: "8Gi", Storage: "100Gi", VMs: 1}); err != nil {
+		t.Errorf("expected the request to fit, got %v", err)
+	}
+	tests := []struct {
+		requested Quota
+		resource  string
+		exceeded  bool
+	}{
+		{Quota{VCPU: 4, VMs: 1}, "vcpu", false},
+		{Quota{VCPU: 16, VMs: 1}, "vcpu", true},
+		{Quota{Memory: "9Gi", VMs: 1}, "memory", false},
+		{Quota{Memory: "32Gi", VMs: 1}, "memory", true},
+	}
+	for _, test := range tests {
+		err := usage.admit(test.requested)
+		quotaErr, ok := err.(*QuotaError)
+		if !ok || quotaErr.Resource != test.resource || quotaErr.Exceeded != test.exceeded {
+			t.Errorf("admit(%+v) = %v; want %s exceeded=%v", test.requested, err, test.resource, test.exceeded)
+		}
+	}
+}
+
+func TestServiceAccountRole(t *testing.T) {
+	project, role, ok := ServiceAccountRole("system:serviceaccount:swift-abc:" + ServiceAccountName("operator"))
+	if !ok || project != "swift-abc" || role != "operator" {
+		t.Errorf("unexpected service account %q %q %v", project, role, ok)
+	}
+	for _, username := range []string{"arthur", "system:serviceaccount:swift-abc:default", "system:serviceaccount:swift-abc"} {
+		if _, _, ok := ServiceAccountRole(username); ok {
+			t.Errorf("expected %q not to be a project service account", username)
+		}
+	}
+}
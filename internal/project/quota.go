@@ -0,0 +1,238 @@
+package project
+
+import (
+	"cloud/internal/clusters"
+	"cloud/internal/clusters/k8s"
+	"cloud/internal/vm"
+	"fmt"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Usage reports the resources a project consumes against its quota. Zero
+// limits are uncapped.
+type Usage struct {
+	Limits Quota `json:"limits"`
+	Used   Quota `json:"used"`
+	// APIOnly lists the limits the cluster does not enforce, which only
+	// apply to virtual machines created through the API.
+	APIOnly []string `json:"api_only,omitempty"`
+}
+
+// QuotaError reports a request that does not fit in the quota of a project.
+// Exceeded is set when the request is larger than the limit itself, so that
+// freeing resources in the project would not help.
+type QuotaError struct {
+	Resource  string
+	Requested string
+	Used      string
+	Limit     string
+	Exceeded  bool
+}
+
+func (e *QuotaError) Error() string {
+	if e.Exceeded {
+		return fmt.Sprintf("requested %s %s exceeds the project quota of %s", e.Resource, e.Requested, e.Limit)
+	}
+	return fmt.Sprintf("requested %s %s exceeds the remaining project quota, %s of %s is in use", e.Resource, e.Requested, e.Used, e.Limit)
+}
+
+// Quota reports the usage of the project named in the request path.
+func (p *Project) Quota() (*Usage, error) {
+	return p.usage(mux.Vars(p.request)["project"])
+}
+
+// SetQuota replaces the quota of the project named in the request path.
+func (p *Project) SetQuota(quota Quota) (*Usage, error) {
+	namespace, err := p.Find()
+	if err != nil {
+		return nil, err
+	}
+	desired, err := NewResourceQuota(namespace.Name, quota)
+	if err != nil {
+		return nil, err
+	}
+	clientSet, err := k8s.ClientSet(p.kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := clusters.WithTimeout(p.ctx)
+	defer cancel()
+
+	quotas := clientSet.CoreV1().ResourceQuotas(namespace.Name)
+	current, err := quotas.Get(ctx, defaultObjectName, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		_, err = quotas.Create(ctx, desired, metav1.CreateOptions{})
+	} else if err == nil {
+		current.Spec.Hard = desired.Spec.Hard
+		if current.Annotations == nil {
+			current.Annotations = map[string]string{}
+		}
+		delete(current.Annotations, VCPUAnnotation)
+		for key, value := range desired.Annotations {
+			current.Annotations[key] = value
+		}
+		_, err = quotas.Update(ctx, current, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p.usage(namespace.Name)
+}
+
+// Admit checks that a virtual machine fits in the remaining quota of the
+// project it is created in.
+func (p *Project) Admit(payload clusters.ResourceDetails) error {
+	usage, err := p.usage(p.project)
+	if err != nil {
+		return err
+	}
+	requested := Quota{
+		VCPU:    int64(payload.Compute.CPU),
+		Memory:  payload.Compute.RAM,
+		Storage: payload.Compute.Storage,
+		VMs:     1,
+	}
+	return usage.admit(requested)
+}
+
+// admit checks that requested fits in the remaining quota.
+func (u *Usage) admit(requested Quota) error {
+	counts := []struct {
+		resource               string
+		requested, used, limit int64
+	}{
+		{"vms", requested.VMs, u.Used.VMs, u.Limits.VMs},
+		{"vcpu", requested.VCPU, u.Used.VCPU, u.Limits.VCPU},
+	}
+	for _, c := range counts {
+		if c.limit <= 0 {
+			continue
+		}
+		if c.requested > c.limit || c.used+c.requested > c.limit {
+			return &QuotaError{
+				Resource:  c.resource,
+				Requested: strconv.FormatInt(c.requested, 10),
+				Used:      strconv.FormatInt(c.used, 10),
+				Limit:     strconv.FormatInt(c.limit, 10),
+				Exceeded:  c.requested > c.limit,
+			}
+		}
+	}
+	quantities := []struct {
+		resource               string
+		requested, used, limit string
+	}{
+		{"memory", requested.Memory, u.Used.Memory, u.Limits.Memory},
+		{"storage", requested.Storage, u.Used.Storage, u.Limits.Storage},
+	}
+	for _, q := range quantities {
+		if q.limit == "" || q.requested == "" {
+			continue
+		}
+		want, err := resource.ParseQuantity(q.requested)
+		if err != nil {
+			// Malformed sizes are reported when the virtual machine is
+			// created.
+			continue
+		}
+		limit := resource.MustParse(q.limit)
+		total := want.DeepCopy()
+		if q.used != "" {
+			total.Add(resource.MustParse(q.used))
+		}
+		if want.Cmp(limit) > 0 || total.Cmp(limit) > 0 {
+			used := q.used
+			if used == "" {
+				used = "0"
+			}
+			return &QuotaError{
+				Resource:  q.resource,
+				Requested: q.requested,
+				Used:      used,
+				Limit:     q.limit,
+				Exceeded:  want.Cmp(limit) > 0,
+			}
+		}
+	}
+	return nil
+}
+
+// usage reads the quota of a project. Memory, storage and VM counts are
+// taken from the status of the ResourceQuota, while vCPUs are counted from
+// the virtual machines as the cluster does not track them.
+func (p *Project) usage(name string) (*Usage, error) {
+	clientSet, err := k8s.ClientSet(p.kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := clusters.WithTimeout(p.ctx)
+	defer cancel()
+
+	usage := &Usage{}
+	resourceQuota, err := clientSet.CoreV1().ResourceQuotas(name).Get(ctx, defaultObjectName, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		// Projects without a quota are uncapped.
+		resourceQuota, err = &corev1.ResourceQuota{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	usage.Limits, usage.Used = quotaOf(resourceQuota.Spec.Hard), quotaOf(resourceQuota.Status.Used)
+	usage.Limits.VCPU, _ = strconv.ParseInt(resourceQuota.Annotations[VCPUAnnotation], 10, 64)
+	if usage.Limits.VCPU > 0 {
+		usage.APIOnly = []string{"vcpu"}
+	}
+
+	vms, err := clusters.ListResourceSchema(ctx, vm.GVKs[0], p.kubeconfig, name, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	usage.Used.VCPU = 0
+	for i := range vms.Items {
+		usage.Used.VCPU += vcpus(&vms.Items[i])
+	}
+	if _, ok := resourceQuota.Spec.Hard[vmCountResource]; !ok {
+		usage.Used.VMs = int64(len(vms.Items))
+	}
+	return usage, nil
+}
+
+// quotaOf reads the resources of a quota object that make up a Quota.
+func quotaOf(list corev1.ResourceList) Quota {
+	quota := Quota{}
+	if memory, ok := list[corev1.ResourceRequestsMemory]; ok {
+		quota.Memory = memory.String()
+	}
+	if storage, ok := list[corev1.ResourceRequestsStorage]; ok {
+		quota.Storage = storage.String()
+	}
+	if vms, ok := list[vmCountResource]; ok {
+		quota.VMs = vms.Value()
+	}
+	return quota
+}
+
+// vcpus counts the vCPUs of a virtual machine.
+func vcpus(obj *unstructured.Unstructured) int64 {
+	total := int64(1)
+	for _, topology := range []string{"cores", "sockets", "threads"} {
+		value, ok, _ := unstructured.NestedFieldNoCopy(obj.Object, "spec", "template", "spec", "domain", "cpu", topology)
+		if !ok {
+			continue
+		}
+		switch n := value.(type) {
+		case int64:
+			total *= n
+		case float64:
+			total *= int64(n)
+		}
+	}
+	return total
+}
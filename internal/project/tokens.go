@@ -0,0 +1,122 @@
+package project
+
+import (
+	"cloud/internal/clusters"
+	"cloud/internal/clusters/k8s"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// serviceAccountPrefix names the service accounts tokens are issued
+	// for, one per role, such as "anvil-operator".
+	serviceAccountPrefix = "anvil-"
+	// serviceAccountUser prefixes the usernames of service accounts.
+	serviceAccountUser = "system:serviceaccount:"
+	// serviceAccountClusterRole is bound to the service accounts of a
+	// project. Tokens are meant to drive the API, which applies the role of
+	// the service account, so they only get read access to the cluster.
+	serviceAccountClusterRole = "view"
+)
+
+// TokenRequest is the request body of issuing a token.
+type TokenRequest struct {
+	Role              string `json:"role,omitempty"`
+	Audience          string `json:"audience,omitempty"`
+	ExpirationSeconds int64  `json:"expiration_seconds,omitempty"`
+}
+
+// Token is a short-lived token issued for a service account of a project.
+type Token struct {
+	Token          string    `json:"token"`
+	ServiceAccount string    `json:"service_account"`
+	Role           string    `json:"role"`
+	Audience       string    `json:"audience"`
+	Expires        time.Time `json:"expires"`
+}
+
+// ServiceAccountName names the service account tokens of role are issued
+// for.
+func ServiceAccountName(role string) string {
+	return serviceAccountPrefix + role
+}
+
+// ServiceAccountRole returns the project and role of the username of a
+// service account that tokens are issued for.
+func ServiceAccountRole(username string) (project, role string, ok bool) {
+	rest, found := strings.CutPrefix(username, serviceAccountUser)
+	if !found {
+		return "", "", false
+	}
+	project, name, found := strings.Cut(rest, ":")
+	if !found {
+		return "", "", false
+	}
+	role, found = strings.CutPrefix(name, serviceAccountPrefix)
+	if !found || role == "" {
+		return "", "", false
+	}
+	return project, role, true
+}
+
+// IssueToken issues a token for the service account of the requested role
+// in the project named in the request path, creating the service account
+// and its role binding when missing.
+func (p *Project) IssueToken(request TokenRequest) (*Token, error) {
+	namespace, err := p.Find()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := clusters.WithTimeout(p.ctx)
+	defer cancel()
+
+	name := ServiceAccountName(request.Role)
+	resource := k8s.NewResource(p.kubeconfig)
+	_, err = resource.CreateServiceAccount(ctx, &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace.Name,
+		},
+	})
+	if err != nil && !k8serrors.IsAlreadyExists(err) {
+		return nil, err
+	}
+	_, err = resource.CreateRoleBinding(ctx, &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace.Name,
+		},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "ClusterRole",
+			Name:     serviceAccountClusterRole,
+		},
+		Subjects: []rbacv1.Subject{
+			{
+				Kind:      rbacv1.ServiceAccountKind,
+				Name:      name,
+				Namespace: namespace.Name,
+			},
+		},
+	})
+	if err != nil && !k8serrors.IsAlreadyExists(err) {
+		return nil, err
+	}
+
+	tokenRequest, err := resource.CreateToken(ctx, namespace.Name, name, []string{request.Audience}, request.ExpirationSeconds)
+	if err != nil {
+		return nil, err
+	}
+	return &Token{
+		Token:          tokenRequest.Status.Token,
+		ServiceAccount: serviceAccountUser + namespace.Name + ":" + name,
+		Role:           request.Role,
+		Audience:       request.Audience,
+		Expires:        tokenRequest.Status.ExpirationTimestamp.Time,
+	}, nil
+}
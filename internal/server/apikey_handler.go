@@ -0,0 +1,139 @@
+package server
+
+import (
+	"cloud/internal/apikey"
+	"cloud/internal/clusters"
+	"encoding/json"
+	"net/http"
+	"slices"
+
+	"github.com/gorilla/mux"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// apiKeyScopes are the permissions API keys can be scoped to.
+var apiKeyScopes = []string{string(permRead), string(permPower), string(permConsole), string(permWrite)}
+
+type createAPIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// createdAPIKey is returned once when an API key is created, the only time
+// the key itself is known.
+type createdAPIKey struct {
+	*apikey.Key
+	Secret string `json:"key"`
+}
+
+// ListAPIKeysHandler lists the API keys of a project. Like creating and
+// deleting keys, it is not open to tokens and API keys.
+func (s *Server) ListAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	crw := customResponseWriter{w: w}
+	project := mux.Vars(r)["project"]
+	if err := s.authorize(r, project, permWrite); err != nil {
+		crw.error(r, err)
+		return
+	}
+	if err := refuseDelegated(r, "list"); err != nil {
+		crw.error(r, err)
+		return
+	}
+	req := newRequest("vm", r)
+	keys, err := apiKeyStore().List(req.ctx, project)
+	if err != nil {
+		crw.error(r, err)
+		return
+	}
+	crw.response(http.StatusOK, "success", keys, nil)
+}
+
+// CreateAPIKeyHandler creates an API key for a project. Callers can only
+// grant the scopes their own role allows, and tokens and API keys cannot be
+// used to create keys.
+func (s *Server) CreateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	crw := customResponseWriter{w: w}
+	project := mux.Vars(r)["project"]
+	if err := s.authorize(r, project, permWrite); err != nil {
+		crw.error(r, err)
+		return
+	}
+	if err := refuseDelegated(r, "create"); err != nil {
+		crw.error(r, err)
+		return
+	}
+	createdBy := ""
+	if claims, ok := claimsFromContext(r.Context()); ok {
+		createdBy = claims.Email
+		if createdBy == "" {
+			createdBy = claims.Subject
+		}
+	}
+	payload := createAPIKeyRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		crw.error(r, err)
+		return
+	}
+	if err := clusters.NewValidationError(payload.validate()); err != nil {
+		crw.error(r, err)
+		return
+	}
+	for _, scope := range payload.Scopes {
+		if err := s.authorize(r, project, permission(scope)); err != nil {
+			crw.error(r, err)
+			return
+		}
+	}
+	req := newRequest("vm", r)
+	key, token, err := apiKeyStore().Create(req.ctx, project, payload.Name, createdBy, payload.Scopes)
+	if err != nil {
+		crw.error(r, err)
+		return
+	}
+	crw.response(http.StatusCreated, "success", createdAPIKey{Key: key, Secret: token}, nil)
+}
+
+func (s *Server) DeleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	crw := customResponseWriter{w: w}
+	vars := mux.Vars(r)
+	if err := s.authorize(r, vars["project"], permWrite); err != nil {
+		crw.error(r, err)
+		return
+	}
+	if err := refuseDelegated(r, "delete"); err != nil {
+		crw.error(r, err)
+		return
+	}
+	req := newRequest("vm", r)
+	if err := apiKeyStore().Delete(req.ctx, vars["project"], vars["id"]); err != nil {
+		crw.error(r, err)
+		return
+	}
+	crw.response(http.StatusOK, "success", nil, nil)
+}
+
+// refuseDelegated forbids tokens and API keys to manage API keys, as they
+// could otherwise mint or revoke credentials outliving their own.
+func refuseDelegated(r *http.Request, action string) error {
+	if claims, ok := claimsFromContext(r.Context()); ok && delegated(claims) {
+		return newAPIError(http.StatusForbidden, "forbidden", "tokens and API keys cannot "+action+" API keys")
+	}
+	return nil
+}
+
+func (p createAPIKeyRequest) validate() field.ErrorList {
+	errs := field.ErrorList{}
+	scopes := field.NewPath("scopes")
+	if len(p.Scopes) == 0 {
+		errs = append(errs, field.Required(scopes, ""))
+	}
+	for i, scope := range p.Scopes {
+		if !slices.Contains(apiKeyScopes, scope) {
+			errs = append(errs, field.NotSupported(scopes.Index(i), scope, apiKeyScopes))
+		}
+	}
+	if len(p.Name) > 253 {
+		errs = append(errs, field.TooLong(field.NewPath("name"), p.Name, 253))
+	}
+	return errs
+}
@@ -0,0 +1,318 @@
+package server
+
+import (
+	"cloud/internal/apikey"
+	"cloud/internal/clusters/k8s"
+	"cloud/internal/project"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gorilla/websocket"
+	"github.com/spf13/viper"
+)
+
+const (
+	claimsKey contextKey = "claims"
+	// tokenSubprotocolPrefix marks a websocket subprotocol carrying a bearer
+	// token, for browser clients that cannot set headers on websockets.
+	tokenSubprotocolPrefix = "bearer."
+	// serviceAccountIssuer is the issuer of the claims of service account
+	// tokens, which are reviewed by the cluster rather than verified.
+	serviceAccountIssuer = "kubernetes"
+	// apiKeyIssuer is the issuer of the claims of API keys.
+	apiKeyIssuer = "apikey"
+)
+
+// Claims are the verified claims of the token a request was made with.
+type Claims struct {
+	Subject string `json:"sub"`
+	Issuer  string `json:"iss"`
+	Email   string `json:"email,omitempty"`
+	// EmailVerified is set by the issuer once the caller has proven they own
+	// Email. Unverified addresses are never matched against projects.
+	EmailVerified bool     `json:"email_verified,omitempty"`
+	Name          string   `json:"name,omitempty"`
+	Groups        []string `json:"groups,omitempty"`
+	// Project and Scopes restrict callers authenticated with an API key to
+	// the project and permissions of the key.
+	Project string   `json:"-"`
+	Scopes  []string `json:"-"`
+}
+
+// verifiedEmail returns the email address of the caller, or an empty string
+// when the issuer has not verified it.
+func (c *Claims) verifiedEmail() string {
+	if !c.EmailVerified {
+		return ""
+	}
+	return c.Email
+}
+
+// claimsFromContext returns the claims of the authenticated caller, if any.
+func claimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsKey).(*Claims)
+	return claims, ok
+}
+
+// authenticator verifies bearer tokens issued by the configured issuer.
+type authenticator struct {
+	verifier *oidc.IDTokenVerifier
+	// adminGroups are the groups whose members administer the platform
+	// rather than a single project.
+	adminGroups []string
+	// kubeconfig and tokenAudiences are used to review the service account
+	// tokens issued for projects, which are accepted alongside user tokens.
+	// Only tokens claiming to be issued by clusterIssuer are reviewed, so
+	// that anonymous callers cannot reach the cluster.
+	kubeconfig     string
+	tokenAudiences []string
+	clusterIssuer  string
+	apiKeys        *apikey.Store
+}
+
+// newAuthenticator builds an authenticator from the AUTH section of the
+// config, or returns nil when authentication is disabled. Signing keys are
+// read from KEY_FILE, fetched from JWKS_URL, or discovered from ISSUER in
+// that order of preference.
+func newAuthenticator(ctx context.Context) (*authenticator, error) {
+	if !viper.GetBool("auth.enabled") {
+		return nil, nil
+	}
+	verifier, err := newVerifier(ctx)
+	if err != nil {
+		return nil, err
+	}
+	a := &authenticator{
+		verifier:       verifier,
+		kubeconfig:     viper.GetString("cluster.vm"),
+		tokenAudiences: tokenAudiences(),
+		clusterIssuer:  viper.GetString("auth.service_account_issuer"),
+		apiKeys:        apiKeyStore(),
+	}
+	if a.clusterIssuer == "" {
+		a.clusterIssuer = "https://kubernetes.default.svc.cluster.local"
+	}
+	for _, group := range strings.Split(viper.GetString("auth.admin_groups"), ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			a.adminGroups = append(a.adminGroups, group)
+		}
+	}
+	return a, nil
+}
+
+// tokenAudiences are the audiences service account tokens may be issued
+// for, and are accepted by the middleware with.
+func tokenAudiences() []string {
+	audiences := []string{}
+	for _, audience := range strings.Split(viper.GetString("auth.token_audiences"), ",") {
+		if audience = strings.TrimSpace(audience); audience != "" {
+			audiences = append(audiences, audience)
+		}
+	}
+	return audiences
+}
+
+// apiKeyStore is where API keys are kept, in the namespace set by
+// API_KEY_NAMESPACE.
+func apiKeyStore() *apikey.Store {
+	namespace := viper.GetString("auth.api_key_namespace")
+	if namespace == "" {
+		namespace = "anvil-system"
+	}
+	return apikey.NewStore(viper.GetString("cluster.vm"), namespace)
+}
+
+// newVerifier builds the verifier of the tokens of the configured issuer.
+func newVerifier(ctx context.Context) (*oidc.IDTokenVerifier, error) {
+	issuer := viper.GetString("auth.issuer")
+	if issuer == "" {
+		return nil, errors.New("auth.issuer is required when authentication is enabled")
+	}
+	config := &oidc.Config{
+		ClientID:          viper.GetString("auth.audience"),
+		SkipClientIDCheck: viper.GetString("auth.audience") == "",
+	}
+
+	if keyFile := viper.GetString("auth.key_file"); keyFile != "" {
+		keys, err := readPublicKeys(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		keySet := &oidc.StaticKeySet{PublicKeys: keys}
+		return oidc.NewVerifier(issuer, keySet, config), nil
+	}
+	if jwksURL := viper.GetString("auth.jwks_url"); jwksURL != "" {
+		keySet := oidc.NewRemoteKeySet(ctx, jwksURL)
+		return oidc.NewVerifier(issuer, keySet, config), nil
+	}
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+	return provider.Verifier(config), nil
+}
+
+// readPublicKeys reads the PEM encoded public keys or certificates of a file.
+func readPublicKeys(path string) ([]crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys := []crypto.PublicKey{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, cert.PublicKey)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no public keys found in %s", path)
+	}
+	return keys, nil
+}
+
+// middleware rejects requests without a valid bearer token and stores the
+// verified claims in the request context.
+func (a *authenticator) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		crw := customResponseWriter{w: w}
+		token := bearerToken(r)
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer`)
+			crw.error(r, newAPIError(http.StatusUnauthorized, "unauthenticated", "a bearer token is required"))
+			return
+		}
+		if r.Header.Get("Authorization") == "" && r.URL.Query().Get("access_token") == "" && tokenOnlySubprotocol(r) {
+			crw.error(r, newAPIError(http.StatusBadRequest, "websocket_protocol_required",
+				fmt.Sprintf("offer the %q subprotocol along with the token", websocketProtocol)))
+			return
+		}
+		claims, err := a.verify(r.Context(), token)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			crw.error(r, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey, claims)))
+	})
+}
+
+// verify returns the claims of an API key or a user token, falling back to
+// reviewing tokens issued by the cluster as project service account tokens.
+// Every failure of the review is reported as an invalid token.
+func (a *authenticator) verify(ctx context.Context, token string) (*Claims, error) {
+	if strings.HasPrefix(token, apikey.Prefix) {
+		key, err := a.apiKeys.Verify(ctx, token)
+		if errors.Is(err, apikey.ErrInvalid) {
+			return nil, newAPIError(http.StatusUnauthorized, "invalid_token", err.Error())
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &Claims{
+			Subject: "apikey:" + key.ID,
+			Issuer:  apiKeyIssuer,
+			Project: key.Project,
+			Scopes:  key.Scopes,
+		}, nil
+	}
+	idToken, err := a.verifier.Verify(ctx, token)
+	if err == nil {
+		claims := &Claims{}
+		if err := idToken.Claims(claims); err != nil {
+			return nil, newAPIError(http.StatusUnauthorized, "invalid_token", err.Error())
+		}
+		return claims, nil
+	}
+	invalid := newAPIError(http.StatusUnauthorized, "invalid_token", err.Error())
+	if len(a.tokenAudiences) == 0 || unverifiedIssuer(token) != a.clusterIssuer {
+		return nil, invalid
+	}
+	review, reviewErr := k8s.NewResource(a.kubeconfig).ReviewToken(ctx, token, a.tokenAudiences)
+	if reviewErr != nil {
+		slog.Error("Unable to review token", "error", reviewErr.Error())
+		return nil, invalid
+	}
+	username := review.Status.User.Username
+	if _, _, ok := project.ServiceAccountRole(username); !review.Status.Authenticated || !ok {
+		return nil, invalid
+	}
+	return &Claims{
+		Subject: username,
+		Issuer:  serviceAccountIssuer,
+		Groups:  review.Status.User.Groups,
+	}, nil
+}
+
+// unverifiedIssuer returns the issuer a JWT claims without verifying it, or
+// an empty string when the token is not a JWT. It only decides whether the
+// token is worth verifying at all.
+func unverifiedIssuer(token string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	claims := struct {
+		Issuer string `json:"iss"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	return claims.Issuer
+}
+
+// bearerToken extracts the token of a request from its Authorization
+// header. Websocket requests may instead pass it in the "access_token" query
+// or as a subprotocol prefixed with "bearer.", offered along with the
+// "anvil" subprotocol that the server agrees to instead.
+func bearerToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, token, found := strings.Cut(header, " ")
+		if found && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+		return ""
+	}
+	if !websocket.IsWebSocketUpgrade(r) {
+		return ""
+	}
+	if token := r.URL.Query().Get("access_token"); token != "" {
+		return token
+	}
+	for _, protocol := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(protocol, tokenSubprotocolPrefix) {
+			return strings.TrimPrefix(protocol, tokenSubprotocolPrefix)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+const testIssuer = "https://id.example.com"
+
+// signToken creates an RS256 signed JWT with the given claims.
+func signToken(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestAuthenticatorMiddleware(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &authenticator{verifier: oidc.NewVerifier(testIssuer, &oidc.StaticKeySet{
+		PublicKeys: []crypto.PublicKey{key.Public()},
+	}, &oidc.Config{SkipClientIDCheck: true})}
+
+	var seen *Claims
+	handler := requestIDMiddleware(auth.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = claimsFromContext(r.Context())
+	})))
+
+	valid := signToken(t, key, map[string]interface{}{
+		"iss":   testIssuer,
+		"sub":   "user-1",
+		"email": "arthur@example.com",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	})
+	expired := signToken(t, key, map[string]interface{}{
+		"iss": testIssuer,
+		"sub": "user-1",
+		"exp": time.Now().Add(-time.Hour).Unix(),
+	})
+
+	tests := []struct {
+		name   string
+		header string
+		query  string
+		status int
+	}{
+		{"missing token", "", "", http.StatusUnauthorized},
+		{"valid token", "Bearer " + valid, "", http.StatusOK},
+		{"expired token", "Bearer " + expired, "", http.StatusUnauthorized},
+		{"query outside websocket", "", "?access_token=" + valid, http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		seen = nil
+		req := httptest.NewRequest(http.MethodGet, "/1.0/virtual-machines"+test.query, nil)
+		if test.header != "" {
+			req.Header.Set("Authorization", test.header)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, rec.Code)
+		}
+		if test.status == http.StatusOK && (seen == nil || seen.Email != "arthur@example.com") {
+			t.Errorf("%s: expected claims in context, got %+v", test.name, seen)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/1.0/virtual-machines/web/console", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Protocol", "binary, "+tokenSubprotocolPrefix+valid)
+	if token := bearerToken(req); token != valid {
+		t.Errorf("expected the token from the websocket subprotocol, got %q", token)
+	}
+}
+
+func TestVerifyReviewsOnlyClusterTokens(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const clusterIssuer = "https://kubernetes.default.svc.cluster.local"
+	auth := &authenticator{
+		verifier: oidc.NewVerifier(testIssuer, &oidc.StaticKeySet{
+			PublicKeys: []crypto.PublicKey{key.Public()},
+		}, &oidc.Config{SkipClientIDCheck: true}),
+		kubeconfig:     "/nonexistent/kubeconfig",
+		tokenAudiences: []string{"anvil"},
+		clusterIssuer:  clusterIssuer,
+	}
+	tokens := map[string]string{
+		"garbage": "not-a-token",
+		"foreign issuer": signToken(t, key, map[string]interface{}{
+			"iss": "https://elsewhere.example.com",
+			"sub": "user-1",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}),
+		// The review fails as the cluster is unreachable, which must not
+		// be reported to the caller as anything but an invalid token.
+		"cluster issuer": signToken(t, key, map[string]interface{}{
+			"iss": clusterIssuer,
+			"sub": "system:serviceaccount:p-1:anvil-viewer",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}),
+	}
+	for name, token := range tokens {
+		_, err := auth.verify(context.Background(), token)
+		apiErr, ok := err.(*apiError)
+		if !ok || apiErr.status != http.StatusUnauthorized || apiErr.Code != "invalid_token" {
+			t.Errorf("%s: expected an invalid token error, got %v", name, err)
+		}
+	}
+	if issuer := unverifiedIssuer(tokens["cluster issuer"]); issuer != clusterIssuer {
+		t.Errorf("expected the unverified issuer %q, got %q", clusterIssuer, issuer)
+	}
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"cloud/internal/clusters/k8s"
+	"cloud/internal/project"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+type role string
+
+const (
+	roleOwner    role = "owner"
+	roleAdmin    role = "admin"
+	roleOperator role = "operator"
+	roleViewer   role = "viewer"
+)
+
+type permission string
+
+const (
+	// permRead covers listing, getting and watching resources.
+	permRead permission = "read"
+	// permPower covers the power actions of virtual machines.
+	permPower permission = "power"
+	// permConsole covers the VNC and serial consoles.
+	permConsole permission = "console"
+	// permWrite covers creating, updating and deleting resources.
+	permWrite permission = "write"
+	// permManage covers deleting the project itself.
+	permManage permission = "manage"
+)
+
+var rolePermissions = map[role][]permission{
+	roleOwner:    {permRead, permPower, permConsole, permWrite, permManage},
+	roleAdmin:    {permRead, permPower, permConsole, permWrite},
+	roleOperator: {permRead, permPower, permConsole},
+	roleViewer:   {permRead},
+}
+
+func (r role) can(perm permission) bool {
+	for _, p := range rolePermissions[r] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize checks that the caller holds a role in the project that grants
+// perm. Every caller is allowed when authentication is disabled.
+func (s *Server) authorize(r *http.Request, projectName string, perm permission) error {
+	if s.auth == nil {
+		return nil
+	}
+	claims, ok := claimsFromContext(r.Context())
+	if !ok {
+		return newAPIError(http.StatusUnauthorized, "unauthenticated", "a bearer token is required")
+	}
+	if claims.Issuer == apiKeyIssuer {
+		return authorizeAPIKey(claims, projectName, perm)
+	}
+	req := newRequest("vm", r)
+	role, err := projectRole(req, claims, projectName)
+	if err != nil {
+		return err
+	}
+	if role == "" {
+		return newAPIError(http.StatusForbidden, "forbidden", fmt.Sprintf("you are not a member of project %q", projectName))
+	}
+	if !role.can(perm) {
+		return newAPIError(http.StatusForbidden, "forbidden", fmt.Sprintf("the %s role does not allow %s access to project %q", role, perm, projectName))
+	}
+	return nil
+}
+
+// authorizeAPIKey checks that an API key is scoped to the project and perm.
+func authorizeAPIKey(claims *Claims, projectName string, perm permission) error {
+	if claims.Project != projectName {
+		return newAPIError(http.StatusForbidden, "forbidden", fmt.Sprintf("the API key does not belong to project %q", projectName))
+	}
+	if !slices.Contains(claims.Scopes, string(perm)) {
+		return newAPIError(http.StatusForbidden, "forbidden", fmt.Sprintf("the API key is not scoped for %s access", perm))
+	}
+	return nil
+}
+
+// delegated reports whether the caller authenticated with a credential
+// issued through the API, which cannot be used to issue further ones.
+func delegated(claims *Claims) bool {
+	return claims.Issuer == serviceAccountIssuer || claims.Issuer == apiKeyIssuer
+}
+
+// authorizeAdmin checks that the caller administers the platform, through
+// one of the configured admin groups. Every caller is allowed when
+// authentication is disabled.
+func (s *Server) authorizeAdmin(r *http.Request) error {
+	if s.auth == nil {
+		return nil
+	}
+	claims, ok := claimsFromContext(r.Context())
+	if !ok {
+		return newAPIError(http.StatusUnauthorized, "unauthenticated", "a bearer token is required")
+	}
+	for _, group := range claims.Groups {
+		for _, admin := range s.auth.adminGroups {
+			if group == admin {
+				return nil
+			}
+		}
+	}
+	return newAPIError(http.StatusForbidden, "forbidden", "only platform administrators are allowed")
+}
+
+// projectRole returns the role of the caller in a project. Callers own the
+// project derived from their verified email address, and hold the role the project
+// namespace assigns them through its members annotation otherwise.
+func projectRole(req *CloudRequest, claims *Claims, projectName string) (role, error) {
+	if role, ok := serviceAccountRole(claims, projectName); ok {
+		return role, nil
+	}
+	if email := claims.verifiedEmail(); email != "" && project.Name(email) == projectName {
+		return roleOwner, nil
+	}
+	namespace, err := k8s.NewResource(req.kubeconfig).Namespace(req.ctx, projectName)
+	if k8serrors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return namespaceRole(claims, namespace.Annotations)
+}
+
+// serviceAccountRole returns the role of callers authenticated with a token
+// issued for a project service account. Such tokens only grant access to
+// their own project.
+func serviceAccountRole(claims *Claims, projectName string) (role, bool) {
+	namespace, name, ok := project.ServiceAccountRole(claims.Subject)
+	if !ok || claims.Issuer != serviceAccountIssuer {
+		return "", false
+	}
+	if namespace != projectName || !issuableRole(role(name)) {
+		return "", true
+	}
+	return role(name), true
+}
+
+// issuableRole reports whether tokens may be issued for a role. Projects
+// have a single owner, so service accounts are at most admins.
+func issuableRole(r role) bool {
+	return r != roleOwner && rolePermissions[r] != nil
+}
+
+// namespaceRole returns the role the annotations of a project namespace
+// assign the caller. Members are matched by verified email address or by
+// subject.
+func namespaceRole(claims *Claims, annotations map[string]string) (role, error) {
+	email := claims.verifiedEmail()
+	if email != "" && strings.EqualFold(annotations[project.OwnerAnnotation], email) {
+		return roleOwner, nil
+	}
+	members, err := projectMembers(annotations[project.MembersAnnotation])
+	if err != nil {
+		return "", err
+	}
+	if email != "" {
+		if role, ok := members[emailMember(email)]; ok {
+			return role, nil
+		}
+	}
+	return members[subjectMember(claims.Subject)], nil
+}
+
+// emailMember and subjectMember key the members of a project. Email
+// addresses are matched regardless of case, subjects exactly, as issuers
+// treat them as opaque and case-sensitive.
+func emailMember(email string) string { return "email:" + strings.ToLower(email) }
+
+func subjectMember(subject string) string { return "sub:" + subject }
+
+// projectMembers parses the members annotation of a project namespace. Each
+// entry is keyed both as an email address and as a subject, as the
+// annotation does not tell them apart.
+func projectMembers(annotation string) (map[string]role, error) {
+	members := map[string]role{}
+	if annotation == "" {
+		return members, nil
+	}
+	raw := map[string]string{}
+	if err := json.Unmarshal([]byte(annotation), &raw); err != nil {
+		return nil, fmt.Errorf("malformed %s annotation: %w", project.MembersAnnotation, err)
+	}
+	for member, r := range raw {
+		if _, ok := rolePermissions[role(r)]; ok {
+			members[emailMember(member)] = role(r)
+			members[subjectMember(member)] = role(r)
+		}
+	}
+	return members, nil
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"cloud/internal/clusters"
+	"cloud/internal/project"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorizeOwnProject(t *testing.T) {
+	s := &Server{auth: &authenticator{}}
+	claims := &Claims{Subject: "user-1", Email: "Arthur@Example.com", EmailVerified: true}
+	r := httptest.NewRequest(http.MethodDelete, "/1.0/virtual-machines/web", nil)
+	r = r.WithContext(context.WithValue(r.Context(), claimsKey, claims))
+	if err := s.authorize(r, project.Name("arthur@example.com"), permWrite); err != nil {
+		t.Errorf("expected owners to be allowed, got %v", err)
+	}
+
+	anonymous := httptest.NewRequest(http.MethodGet, "/1.0/virtual-machines", nil)
+	var apiErr *apiError
+	if err := s.authorize(anonymous, "swift-abc", permRead); !errors.As(err, &apiErr) || apiErr.status != http.StatusUnauthorized {
+		t.Errorf("expected unauthenticated callers to be rejected, got %v", err)
+	}
+	if err := (&Server{}).authorize(anonymous, "swift-abc", permWrite); err != nil {
+		t.Errorf("expected everything to be allowed without authentication, got %v", err)
+	}
+}
+
+func TestUnverifiedEmailGetsNoRole(t *testing.T) {
+	claims := &Claims{Subject: "user-2", Email: "arthur@example.com"}
+	if claims.verifiedEmail() != "" {
+		t.Error("expected an unverified email not to be used")
+	}
+	annotations := map[string]string{
+		project.OwnerAnnotation:   "arthur@example.com",
+		project.MembersAnnotation: `{"arthur@example.com": "admin"}`,
+	}
+	if role, err := namespaceRole(claims, annotations); err != nil || role != "" {
+		t.Errorf("expected an unverified email to get no role, got %q %v", role, err)
+	}
+	claims.EmailVerified = true
+	if role, _ := namespaceRole(claims, annotations); role != roleOwner {
+		t.Errorf("expected a verified email to own the project, got %q", role)
+	}
+}
+
+func TestProjectMembers(t *testing.T) {
+	members, err := projectMembers(`{"Ops@Example.com": "operator", "ci-bot": "viewer", "eve": "superuser"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if members[emailMember("OPS@example.com")] != roleOperator || members[subjectMember("ci-bot")] != roleViewer {
+		t.Errorf("unexpected members %v", members)
+	}
+	if _, ok := members[subjectMember("eve")]; ok {
+		t.Error("expected unknown roles to be ignored")
+	}
+	if !roleOperator.can(permPower) || roleOperator.can(permWrite) || roleViewer.can(permConsole) {
+		t.Error("unexpected role permissions")
+	}
+	if _, err := projectMembers("not json"); err == nil {
+		t.Error("expected a malformed annotation to fail")
+	}
+}
+
+func TestNamespaceRoleMatchesSubjectsExactly(t *testing.T) {
+	annotations := map[string]string{
+		project.MembersAnnotation: `{"AbC123": "admin", "Ops@Example.com": "operator"}`,
+	}
+	tests := []struct {
+		name   string
+		claims *Claims
+		role   role
+	}{
+		{"exact subject", &Claims{Subject: "AbC123"}, roleAdmin},
+		{"subject in another case", &Claims{Subject: "abc123"}, ""},
+		{"email in another case", &Claims{Subject: "u-1", Email: "ops@example.com", EmailVerified: true}, roleOperator},
+		{"subject matching an email entry in another case", &Claims{Subject: "ops@example.com"}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			role, err := namespaceRole(test.claims, annotations)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if role != test.role {
+				t.Errorf("expected role %q, got %q", test.role, role)
+			}
+		})
+	}
+}
+
+func TestServiceAccountRole(t *testing.T) {
+	claims := &Claims{Subject: "system:serviceaccount:swift-abc:anvil-operator", Issuer: serviceAccountIssuer}
+	if role, ok := serviceAccountRole(claims, "swift-abc"); !ok || role != roleOperator {
+		t.Errorf("expected the operator role, got %q", role)
+	}
+	if role, ok := serviceAccountRole(claims, "swift-def"); !ok || role != "" {
+		t.Errorf("expected no role in other projects, got %q", role)
+	}
+	owner := &Claims{Subject: "system:serviceaccount:swift-abc:anvil-owner", Issuer: serviceAccountIssuer}
+	if role, _ := serviceAccountRole(owner, "swift-abc"); role != "" {
+		t.Errorf("expected service accounts never to own projects, got %q", role)
+	}
+}
+
+func TestValidateTokenRequest(t *testing.T) {
+	request := &project.TokenRequest{}
+	if err := validateTokenRequest(request, []string{"anvil"}); err != nil {
+		t.Fatal(err)
+	}
+	if request.Role != "viewer" || request.Audience != "anvil" || request.ExpirationSeconds != 3600 {
+		t.Errorf("unexpected defaults %+v", request)
+	}
+	invalid := &project.TokenRequest{Role: "owner", Audience: "elsewhere", ExpirationSeconds: 60}
+	var validationErr *clusters.ValidationError
+	if err := validateTokenRequest(invalid, []string{"anvil"}); !errors.As(err, &validationErr) || len(validationErr.Errors) != 3 {
+		t.Errorf("expected 3 validation errors, got %v", err)
+	}
+}
+
+func TestAuthorizeAPIKey(t *testing.T) {
+	s := &Server{auth: &authenticator{}}
+	claims := &Claims{Subject: "apikey:0123abcd", Issuer: apiKeyIssuer, Project: "swift-abc", Scopes: []string{"read", "power"}}
+	r := httptest.NewRequest(http.MethodPost, "/1.0/virtual-machines/web/start", nil)
+	r = r.WithContext(context.WithValue(r.Context(), claimsKey, claims))
+	if err := s.authorize(r, "swift-abc", permPower); err != nil {
+		t.Errorf("expected scoped permissions to be allowed, got %v", err)
+	}
+	for _, test := range []struct {
+		project string
+		perm    permission
+	}{{"swift-abc", permWrite}, {"swift-def", permRead}} {
+		var apiErr *apiError
+		if err := s.authorize(r, test.project, test.perm); !errors.As(err, &apiErr) || apiErr.status != http.StatusForbidden {
+			t.Errorf("expected %s on %s to be forbidden, got %v", test.perm, test.project, err)
+		}
+	}
+}
+
+func TestRefuseDelegated(t *testing.T) {
+	for _, test := range []struct {
+		claims  *Claims
+		refused bool
+	}{
+		{&Claims{Subject: "user-1", Email: "arthur@example.com", EmailVerified: true}, false},
+		{&Claims{Subject: "apikey:0123abcd", Issuer: apiKeyIssuer}, true},
+		{&Claims{Subject: "system:serviceaccount:swift-abc:anvil-admin", Issuer: serviceAccountIssuer}, true},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/1.0/projects/swift-abc/api-keys", nil)
+		r = r.WithContext(context.WithValue(r.Context(), claimsKey, test.claims))
+		var apiErr *apiError
+		err := refuseDelegated(r, "list")
+		if refused := errors.As(err, &apiErr) && apiErr.status == http.StatusForbidden; refused != test.refused {
+			t.Errorf("%s: expected refused %v, got %v", test.claims.Subject, test.refused, err)
+		}
+	}
+}
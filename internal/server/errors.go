@@ -0,0 +1,190 @@
+package server
+
+import (
+	"cloud/internal/clusters"
+	"cloud/internal/project"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// apiError is the error returned to clients. Code is a stable, machine
+// readable identifier while Message is meant for humans.
+type apiError struct {
+	status    int
+	Code      string        `json:"code"`
+	Message   string        `json:"message"`
+	Details   []errorDetail `json:"details,omitempty"`
+	RequestID string        `json:"request_id,omitempty"`
+}
+
+// errorDetail points at the part of a request that caused an error.
+type errorDetail struct {
+	Field   string `json:"field,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+// newAPIError creates an error that is returned to clients as is.
+func newAPIError(status int, code, message string, details ...errorDetail) *apiError {
+	return &apiError{status: status, Code: code, Message: message, Details: details}
+}
+
+// statusReasons maps the reasons of Kubernetes status errors to the status
+// and code returned to clients. Unauthorized is reported as a gateway error
+// as it concerns the credentials of this service, not of the client.
+var statusReasons = map[metav1.StatusReason]struct {
+	status int
+	code   string
+}{
+	metav1.StatusReasonNotFound:              {http.StatusNotFound, "not_found"},
+	metav1.StatusReasonAlreadyExists:         {http.StatusConflict, "already_exists"},
+	metav1.StatusReasonConflict:              {http.StatusConflict, "conflict"},
+	metav1.StatusReasonForbidden:             {http.StatusForbidden, "forbidden"},
+	metav1.StatusReasonUnauthorized:          {http.StatusBadGateway, "cluster_unauthorized"},
+	metav1.StatusReasonInvalid:               {http.StatusUnprocessableEntity, "invalid"},
+	metav1.StatusReasonBadRequest:            {http.StatusBadRequest, "bad_request"},
+	metav1.StatusReasonGone:                  {http.StatusGone, "gone"},
+	metav1.StatusReasonExpired:               {http.StatusGone, "expired"},
+	metav1.StatusReasonTooManyRequests:       {http.StatusTooManyRequests, "too_many_requests"},
+	metav1.StatusReasonTimeout:               {http.StatusGatewayTimeout, "timeout"},
+	metav1.StatusReasonServerTimeout:         {http.StatusGatewayTimeout, "timeout"},
+	metav1.StatusReasonMethodNotAllowed:      {http.StatusMethodNotAllowed, "method_not_allowed"},
+	metav1.StatusReasonRequestEntityTooLarge: {http.StatusRequestEntityTooLarge, "too_large"},
+	metav1.StatusReasonServiceUnavailable:    {http.StatusServiceUnavailable, "unavailable"},
+	metav1.StatusReasonInternalError:         {http.StatusInternalServerError, "internal"},
+}
+
+// toAPIError maps any error raised while serving a request to an apiError.
+func toAPIError(err error) *apiError {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	var validationErr *clusters.ValidationError
+	if errors.As(err, &validationErr) {
+		e := newAPIError(http.StatusBadRequest, "validation_failed", "the request is invalid")
+		for _, fieldErr := range validationErr.Errors {
+			e.Details = append(e.Details, errorDetail{
+				Field:   fieldErr.Field,
+				Reason:  string(fieldErr.Type),
+				Message: fieldErr.ErrorBody(),
+			})
+		}
+		return e
+	}
+
+	var quotaErr *project.QuotaError
+	if errors.As(err, &quotaErr) {
+		status := http.StatusConflict
+		if quotaErr.Exceeded {
+			status = http.StatusForbidden
+		}
+		return newAPIError(status, "quota_exceeded", quotaErr.Error(), errorDetail{
+			Field:   quotaErr.Resource,
+			Reason:  "QuotaExceeded",
+			Message: fmt.Sprintf("requested %s, %s of %s in use", quotaErr.Requested, quotaErr.Used, quotaErr.Limit),
+		})
+	}
+
+	var statusErr k8serrors.APIStatus
+	if errors.As(err, &statusErr) {
+		status := statusErr.Status()
+		mapped, ok := statusReasons[status.Reason]
+		if !ok {
+			code := int(status.Code)
+			if code < 400 {
+				code = http.StatusInternalServerError
+			}
+			mapped.status, mapped.code = code, "cluster_error"
+		}
+		e := newAPIError(mapped.status, mapped.code, status.Message)
+		if status.Details != nil {
+			for _, cause := range status.Details.Causes {
+				e.Details = append(e.Details, errorDetail{
+					Field:   cause.Field,
+					Reason:  string(cause.Type),
+					Message: cause.Message,
+				})
+			}
+		}
+		return e
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return newAPIError(http.StatusBadRequest, "invalid_payload", "request body is empty or truncated")
+	case errors.As(err, &syntaxErr):
+		return newAPIError(http.StatusBadRequest, "invalid_payload", err.Error())
+	case errors.As(err, &typeErr):
+		return newAPIError(http.StatusBadRequest, "invalid_payload", err.Error(), errorDetail{
+			Field:   typeErr.Field,
+			Reason:  "FieldValueInvalid",
+			Message: "expected " + typeErr.Type.String(),
+		})
+	case errors.Is(err, context.DeadlineExceeded):
+		return newAPIError(http.StatusGatewayTimeout, "timeout", "the cluster did not respond in time")
+	case errors.Is(err, context.Canceled):
+		return newAPIError(499, "canceled", "the request was canceled")
+	case meta.IsNoMatchError(err):
+		return newAPIError(http.StatusServiceUnavailable, "kind_unavailable", err.Error())
+	case discovery.IsGroupDiscoveryFailedError(err):
+		return newAPIError(http.StatusBadGateway, "discovery_failed", err.Error())
+	case clientcmd.IsConfigurationInvalid(err), clientcmd.IsEmptyConfig(err), errors.Is(err, fs.ErrNotExist):
+		return newAPIError(http.StatusInternalServerError, "cluster_misconfigured", "the cluster connection is not configured correctly")
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return newAPIError(http.StatusGatewayTimeout, "timeout", "the cluster did not respond in time")
+		}
+		return newAPIError(http.StatusBadGateway, "cluster_unreachable", "the cluster could not be reached")
+	}
+	return newAPIError(http.StatusInternalServerError, "internal", internalMessage)
+}
+
+// internalMessage is all clients are told of unexpected errors, as their
+// text may describe the cluster. The error itself is logged along with the
+// request ID, which the message asks clients to quote.
+const internalMessage = "an internal error occurred"
+
+// error maps err to an apiError and writes it to the client.
+func (rw customResponseWriter) error(r *http.Request, err error) {
+	e := *toAPIError(err)
+	e.RequestID = requestID(r.Context())
+	if e.Message == internalMessage && e.RequestID != "" {
+		e.Message = fmt.Sprintf("%s, quote request %s when reporting it", internalMessage, e.RequestID)
+	}
+	if e.status >= http.StatusInternalServerError {
+		slog.Error("Request failed", "request_id", e.RequestID, "code", e.Code, "message", err.Error())
+	} else {
+		slog.Warn("Request rejected", "request_id", e.RequestID, "code", e.Code, "message", err.Error())
+	}
+	rw.w.Header().Set("Content-Type", "application/json")
+	data, _ := json.Marshal(responseBody{
+		Status:  e.status,
+		Message: e.Message,
+		Error:   &e,
+	})
+	rw.w.WriteHeader(e.status)
+	rw.w.Write(data)
+}
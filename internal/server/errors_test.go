@@ -0,0 +1,73 @@
+package server
+
+import (
+	"cloud/internal/project"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func TestToAPIError(t *testing.T) {
+	vms := schema.GroupResource{Group: "kubevirt.io", Resource: "virtualmachines"}
+	var payload struct{ Compute struct{ CPU float64 } }
+	typeErr := json.NewDecoder(strings.NewReader(`{"Compute": {"CPU": "two"}}`)).Decode(&payload)
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{k8serrors.NewNotFound(vms, "web"), http.StatusNotFound, "not_found"},
+		{k8serrors.NewAlreadyExists(vms, "web"), http.StatusConflict, "already_exists"},
+		{k8serrors.NewConflict(vms, "web", errors.New("stale")), http.StatusConflict, "conflict"},
+		{k8serrors.NewForbidden(vms, "web", errors.New("denied")), http.StatusForbidden, "forbidden"},
+		{k8serrors.NewBadRequest("bad"), http.StatusBadRequest, "bad_request"},
+		{fmt.Errorf("listing: %w", context.DeadlineExceeded), http.StatusGatewayTimeout, "timeout"},
+		{json.NewDecoder(strings.NewReader("")).Decode(&payload), http.StatusBadRequest, "invalid_payload"},
+		{typeErr, http.StatusBadRequest, "invalid_payload"},
+		{&project.QuotaError{Resource: "vcpu", Requested: "4", Used: "6", Limit: "8"}, http.StatusConflict, "quota_exceeded"},
+		{&project.QuotaError{Resource: "vcpu", Requested: "16", Used: "0", Limit: "8", Exceeded: true}, http.StatusForbidden, "quota_exceeded"},
+		{errors.New("boom"), http.StatusInternalServerError, "internal"},
+	}
+	for _, test := range tests {
+		e := toAPIError(test.err)
+		if e.status != test.status || e.Code != test.code {
+			t.Errorf("toAPIError(%v) = %d %s; want %d %s", test.err, e.status, e.Code, test.status, test.code)
+		}
+	}
+}
+
+func TestToAPIErrorInvalidCauses(t *testing.T) {
+	err := k8serrors.NewInvalid(schema.GroupKind{Group: "kubevirt.io", Kind: "VirtualMachine"}, "web", field.ErrorList{
+		field.Invalid(field.NewPath("spec", "runStrategy"), "Sometimes", "unsupported"),
+	})
+	e := toAPIError(err)
+	if e.status != http.StatusUnprocessableEntity || e.Code != "invalid" {
+		t.Fatalf("unexpected mapping %d %s", e.status, e.Code)
+	}
+	if len(e.Details) != 1 || e.Details[0].Field != "spec.runStrategy" {
+		t.Errorf("expected the field cause in details, got %+v", e.Details)
+	}
+}
+
+func TestInternalErrorsAreNotDisclosed(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/1.0/virtual-machines", nil)
+	r = r.WithContext(context.WithValue(r.Context(), requestIDKey, "req-1"))
+	w := httptest.NewRecorder()
+	customResponseWriter{w: w}.error(r, errors.New("dial tcp 10.0.0.1:6443: secret detail"))
+	body := w.Body.String()
+	if w.Code != http.StatusInternalServerError || strings.Contains(body, "secret detail") {
+		t.Errorf("expected a generic internal error, got %d %s", w.Code, body)
+	}
+	if !strings.Contains(body, "quote request req-1") {
+		t.Errorf("expected the message to carry the request ID, got %s", body)
+	}
+}
@@ -1,13 +1,11 @@
 package server
 
 import (
-	"crypto/sha256"
-	"encoding/base32"
+	"cloud/internal/clusters"
+	"cloud/internal/project"
 	"encoding/json"
-	"fmt"
 	"log/slog"
 	"net/http"
-	"strings"
 
 	"github.com/gorilla/mux"
 )
@@ -18,6 +16,7 @@ type responseBody struct {
 	Meta    interface{} `json:"meta,omitempty"`
 	Status  int         `json:"status,omitempty"`
 	Message string      `json:"message,omitempty"`
+	Error   *apiError   `json:"error,omitempty"`
 }
 
 // customResponseWriter is a custom response writer that implements the http.ResponseWriter interface.
@@ -55,7 +54,16 @@ func (s *Server) HelloWorldHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
-	jsonResp := []byte(`{"alive": true}`)
+	resp := map[string]interface{}{
+		"alive": true,
+	}
+	if status := clusters.CacheStatus(); len(status) > 0 {
+		resp["cache"] = status
+	}
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		slog.Error("error handling JSON marshal.", "error", err.Error())
+	}
 	_, _ = w.Write(jsonResp)
 }
 
@@ -63,15 +71,5 @@ func (s *Server) hashGen(w http.ResponseWriter, r *http.Request) {
 	crw := customResponseWriter{w: w}
 	vars := mux.Vars(r)
 	email := vars["email"]
-	normalizedEmail := strings.ToLower(strings.TrimSpace(email))
-    hasher := sha256.New()
-    hasher.Write([]byte(normalizedEmail))
-    hash := hasher.Sum(nil)
-    // Base32 encoding is case-insensitive and safe for DNS names.
-    encoded := base32.StdEncoding.EncodeToString(hash)
-    // Shorten the encoded string and convert to lowercase.
-    shortened := strings.ToLower(encoded[:20])
-    // Add a consistent prefix or suffix for clarity (important!)
-    namespaceName := fmt.Sprintf("swift-%s", shortened)
-	crw.response(http.StatusOK, "success", namespaceName, nil)
-}
\ No newline at end of file
+	crw.response(http.StatusOK, "success", project.Name(email), nil)
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"cloud/internal/clusters"
+	"cloud/internal/project"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// createProjectRequest is the payload of CreateProjectHandler. The owner is
+// only read when authentication is disabled, callers own the project derived
+// from their email address otherwise.
+type createProjectRequest struct {
+	Owner string `json:"owner"`
+}
+
+func (s *Server) ListProjectsHandler(w http.ResponseWriter, r *http.Request) {
+	crw := customResponseWriter{w: w}
+	req := newRequest("vm", r)
+	namespaces, err := project.NewCluster(req.useProject("")).FindAll()
+	if err != nil {
+		crw.error(r, err)
+		return
+	}
+	projects := []*project.Info{}
+	for i := range namespaces {
+		ok, err := s.isMember(r, &namespaces[i])
+		if err != nil {
+			// A project that cannot be checked, such as one with a malformed
+			// members annotation, is left out rather than failing the list.
+			slog.Warn("Unable to check project membership", "request_id", requestID(r.Context()), "project", namespaces[i].Name, "error", err.Error())
+			continue
+		}
+		if !ok {
+			continue
+		}
+		projects = append(projects, project.NewInfo(&namespaces[i]))
+	}
+	crw.response(http.StatusOK, "success", projects, nil)
+}
+
+func (s *Server) CreateProjectHandler(w http.ResponseWriter, r *http.Request) {
+	crw := customResponseWriter{w: w}
+	payload := createProjectRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil && !errors.Is(err, io.EOF) {
+		crw.error(r, newAPIError(http.StatusBadRequest, "invalid_payload", err.Error()))
+		return
+	}
+	owner := payload.Owner
+	if s.auth != nil {
+		claims, ok := claimsFromContext(r.Context())
+		if !ok || claims.verifiedEmail() == "" {
+			crw.error(r, newAPIError(http.StatusForbidden, "forbidden", "a verified email address is required to own a project"))
+			return
+		}
+		if owner != "" && !strings.EqualFold(owner, claims.Email) {
+			crw.error(r, newAPIError(http.StatusForbidden, "forbidden", "projects can only be created for yourself"))
+			return
+		}
+		owner = claims.Email
+	}
+	if strings.TrimSpace(owner) == "" {
+		crw.error(r, newAPIError(http.StatusBadRequest, "owner_required", "owner is required"))
+		return
+	}
+	req := newRequest("vm", r)
+	namespace, created, err := project.NewCluster(req.useProject("")).Create(owner, defaultQuota())
+	if err != nil {
+		crw.error(r, err)
+		return
+	}
+	if !created {
+		crw.response(http.StatusOK, "already exists", project.NewInfo(namespace), nil)
+		return
+	}
+	crw.response(http.StatusCreated, "success", project.NewInfo(namespace), nil)
+}
+
+func (s *Server) GetProjectHandler(w http.ResponseWriter, r *http.Request) {
+	crw := customResponseWriter{w: w}
+	if err := s.authorize(r, mux.Vars(r)["project"], permRead); err != nil {
+		crw.error(r, err)
+		return
+	}
+	req := newRequest("vm", r)
+	namespace, err := project.NewCluster(req.useProject("")).Find()
+	if err != nil {
+		crw.error(r, err)
+		return
+	}
+	crw.response(http.StatusOK, "success", project.NewInfo(namespace), nil)
+}
+
+func (s *Server) DeleteProjectHandler(w http.ResponseWriter, r *http.Request) {
+	crw := customResponseWriter{w: w}
+	if err := s.authorize(r, mux.Vars(r)["project"], permManage); err != nil {
+		crw.error(r, err)
+		return
+	}
+	req := newRequest("vm", r)
+	// Keys are revoked first, so that a failure leaves none behind for a
+	// project re-created under the same name.
+	if err := apiKeyStore().DeleteAll(req.ctx, mux.Vars(r)["project"]); err != nil {
+		crw.error(r, err)
+		return
+	}
+	if err := project.NewCluster(req.useProject("")).Delete(); err != nil {
+		crw.error(r, err)
+		return
+	}
+	crw.response(http.StatusOK, "success", nil, nil)
+}
+
+func (s *Server) GetProjectQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	crw := customResponseWriter{w: w}
+	if err := s.authorize(r, mux.Vars(r)["project"], permRead); err != nil {
+		crw.error(r, err)
+		return
+	}
+	req := newRequest("vm", r)
+	usage, err := project.NewCluster(req.useProject("")).Quota()
+	if err != nil {
+		crw.error(r, err)
+		return
+	}
+	crw.response(http.StatusOK, "success", usage, nil)
+}
+
+// SetProjectQuotaHandler replaces the quota of a project. Quotas are set by
+// platform administrators, as project owners could otherwise lift their own.
+// The vCPU cap is only checked when virtual machines are created through the
+// API, which the response reports.
+func (s *Server) SetProjectQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	crw := customResponseWriter{w: w}
+	if err := s.authorizeAdmin(r); err != nil {
+		crw.error(r, err)
+		return
+	}
+	quota := project.Quota{}
+	if err := json.NewDecoder(r.Body).Decode(&quota); err != nil {
+		crw.error(r, err)
+		return
+	}
+	if err := clusters.NewValidationError(quota.Validate()); err != nil {
+		crw.error(r, err)
+		return
+	}
+	req := newRequest("vm", r)
+	usage, err := project.NewCluster(req.useProject("")).SetQuota(quota)
+	if err != nil {
+		crw.error(r, err)
+		return
+	}
+	crw.response(http.StatusOK, "success", usage, nil)
+}
+
+// CreateProjectTokenHandler issues a short-lived token for a service account
+// of a project, for automation such as CI pipelines to drive the API with.
+// Tokens and API keys cannot be used to issue tokens.
+func (s *Server) CreateProjectTokenHandler(w http.ResponseWriter, r *http.Request) {
+	crw := customResponseWriter{w: w}
+	if err := s.authorize(r, mux.Vars(r)["project"], permWrite); err != nil {
+		crw.error(r, err)
+		return
+	}
+	if claims, ok := claimsFromContext(r.Context()); ok && delegated(claims) {
+		crw.error(r, newAPIError(http.StatusForbidden, "forbidden", "tokens and API keys cannot issue tokens"))
+		return
+	}
+	request := project.TokenRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+		crw.error(r, err)
+		return
+	}
+	if err := validateTokenRequest(&request, tokenAudiences()); err != nil {
+		crw.error(r, err)
+		return
+	}
+	req := newRequest("vm", r)
+	token, err := project.NewCluster(req.useProject("")).IssueToken(request)
+	if err != nil {
+		crw.error(r, err)
+		return
+	}
+	crw.response(http.StatusCreated, "success", token, nil)
+}
+
+const (
+	defaultTokenExpiration = time.Hour
+	// minTokenExpiration is the shortest expiration the cluster accepts.
+	minTokenExpiration = 10 * time.Minute
+	maxTokenExpiration = 24 * time.Hour
+)
+
+// validateTokenRequest defaults and checks a token request. Tokens are
+// issued for one of the audiences the middleware accepts them with.
+func validateTokenRequest(request *project.TokenRequest, audiences []string) error {
+	if len(audiences) == 0 {
+		return newAPIError(http.StatusNotImplemented, "tokens_disabled", "no token audiences are configured")
+	}
+	if request.Role == "" {
+		request.Role = string(roleViewer)
+	}
+	if request.Audience == "" {
+		request.Audience = audiences[0]
+	}
+	if request.ExpirationSeconds == 0 {
+		request.ExpirationSeconds = int64(defaultTokenExpiration.Seconds())
+	}
+
+	errs := field.ErrorList{}
+	if !issuableRole(role(request.Role)) {
+		errs = append(errs, field.NotSupported(field.NewPath("role"), request.Role, []string{string(roleAdmin), string(roleOperator), string(roleViewer)}))
+	}
+	if !slices.Contains(audiences, request.Audience) {
+		errs = append(errs, field.NotSupported(field.NewPath("audience"), request.Audience, audiences))
+	}
+	expiration := time.Duration(request.ExpirationSeconds) * time.Second
+	if expiration < minTokenExpiration || expiration > maxTokenExpiration {
+		errs = append(errs, field.Invalid(field.NewPath("expiration_seconds"), request.ExpirationSeconds,
+			fmt.Sprintf("must be between %d and %d", int64(minTokenExpiration.Seconds()), int64(maxTokenExpiration.Seconds()))))
+	}
+	return clusters.NewValidationError(errs)
+}
+
+// quotaAdmission checks virtual machines against the remaining quota of the
+// project they are created in.
+func quotaAdmission(resource clusters.Resource) func(clusters.ResourceDetails) error {
+	return project.NewCluster(resource).Admit
+}
+
+// isMember reports whether the caller holds a role in a project namespace.
+func (s *Server) isMember(r *http.Request, namespace *corev1.Namespace) (bool, error) {
+	if s.auth == nil {
+		return true, nil
+	}
+	claims, ok := claimsFromContext(r.Context())
+	if !ok {
+		return false, nil
+	}
+	if claims.Issuer == apiKeyIssuer {
+		return claims.Project == namespace.Name, nil
+	}
+	if role, ok := serviceAccountRole(claims, namespace.Name); ok {
+		return role != "", nil
+	}
+	if email := claims.verifiedEmail(); email != "" && project.Name(email) == namespace.Name {
+		return true, nil
+	}
+	role, err := namespaceRole(claims, namespace.Annotations)
+	return role != "", err
+}
+
+// defaultQuota is the quota new projects are created with.
+func defaultQuota() project.Quota {
+	return project.Quota{
+		VCPU:    viper.GetInt64("project.quota_vcpu"),
+		Memory:  viper.GetString("project.quota_memory"),
+		Storage: viper.GetString("project.quota_storage"),
+		VMs:     viper.GetInt64("project.quota_vms"),
+	}
+}
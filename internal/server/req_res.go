@@ -18,8 +18,10 @@ type CloudRequest struct {
 }
 
 func newRequest(resource string, request *http.Request) *CloudRequest {
-	rid := uuid.New().String()
-	ctx := context.WithValue(request.Context(), "request_id", rid)
+	ctx := request.Context()
+	if requestID(ctx) == "" {
+		ctx = context.WithValue(ctx, requestIDKey, uuid.New().String())
+	}
 	kubeconfig := ""
 	switch resource {
 	case "vm":
@@ -0,0 +1,22 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewRequestKeepsTheRequestContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest(http.MethodGet, "/1.0/virtual-machines", nil).WithContext(ctx)
+	resource := newRequest("vm", r).useProject("swift-abc")
+	if requestID(resource.Ctx) == "" {
+		t.Error("expected a request ID in the cluster context")
+	}
+	cancel()
+	if !errors.Is(resource.Ctx.Err(), context.Canceled) {
+		t.Errorf("expected cancelling the request to cancel cluster calls, got %v", resource.Ctx.Err())
+	}
+}
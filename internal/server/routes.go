@@ -8,14 +8,47 @@ import (
 
 func (s *Server) RegisterRoutes() http.Handler {
 	r := mux.NewRouter()
+	r.Use(requestIDMiddleware)
 
 	api := r.PathPrefix("/1.0").Subrouter()
 
 	api.HandleFunc("/", s.HelloWorldHandler)
 	api.HandleFunc("/health", s.healthHandler)
-	api.HandleFunc("/hash/{email}", s.hashGen).Methods(http.MethodGet)
 
-	instances := api.PathPrefix("/virtual-machines").Subrouter()
+	// Every route registered below requires authentication when enabled.
+	protected := api.NewRoute().Subrouter()
+	if s.auth != nil {
+		protected.Use(s.auth.middleware)
+	}
+	protected.HandleFunc("/hash/{email}", s.hashGen).Methods(http.MethodGet)
+
+	projects := protected.PathPrefix("/projects").Subrouter()
+	projects.HandleFunc("", s.ListProjectsHandler).Methods(http.MethodGet)
+	projects.HandleFunc("", s.CreateProjectHandler).Methods(http.MethodPost)
+	projects.HandleFunc("/{project}", s.GetProjectHandler).Methods(http.MethodGet)
+	projects.HandleFunc("/{project}", s.DeleteProjectHandler).Methods(http.MethodDelete)
+	projects.HandleFunc("/{project}/quota", s.GetProjectQuotaHandler).Methods(http.MethodGet)
+	projects.HandleFunc("/{project}/quota", s.SetProjectQuotaHandler).Methods(http.MethodPut)
+	projects.HandleFunc("/{project}/tokens", s.CreateProjectTokenHandler).Methods(http.MethodPost)
+	projects.HandleFunc("/{project}/api-keys", s.ListAPIKeysHandler).Methods(http.MethodGet)
+	projects.HandleFunc("/{project}/api-keys", s.CreateAPIKeyHandler).Methods(http.MethodPost)
+	projects.HandleFunc("/{project}/api-keys/{id}", s.DeleteAPIKeyHandler).Methods(http.MethodDelete)
+
+	secrets := protected.PathPrefix("/secrets").Subrouter()
+	secrets.HandleFunc("", s.ListSecretsHandler).Methods(http.MethodGet)
+	secrets.HandleFunc("", s.CreateSecretHandler).Methods(http.MethodPost)
+	secrets.HandleFunc("/{name}", s.GetSecretHandler).Methods(http.MethodGet)
+	secrets.HandleFunc("/{name}", s.UpdateSecretHandler).Methods(http.MethodPut)
+	secrets.HandleFunc("/{name}", s.DeleteSecretHandler).Methods(http.MethodDelete)
+
+	configMaps := protected.PathPrefix("/configmaps").Subrouter()
+	configMaps.HandleFunc("", s.ListConfigMapsHandler).Methods(http.MethodGet)
+	configMaps.HandleFunc("", s.CreateConfigMapHandler).Methods(http.MethodPost)
+	configMaps.HandleFunc("/{name}", s.GetConfigMapHandler).Methods(http.MethodGet)
+	configMaps.HandleFunc("/{name}", s.UpdateConfigMapHandler).Methods(http.MethodPut)
+	configMaps.HandleFunc("/{name}", s.DeleteConfigMapHandler).Methods(http.MethodDelete)
+
+	instances := protected.PathPrefix("/virtual-machines").Subrouter()
 	instances.HandleFunc("", s.ListVMInstancesHandler).Methods(http.MethodGet)
 	instances.HandleFunc("", s.CreateVMInstanceHandler).Methods(http.MethodPost)
 	instances.HandleFunc("/watch", s.WatchVMInstanceHandler).Methods(http.MethodGet)	
@@ -23,6 +56,14 @@ func (s *Server) RegisterRoutes() http.Handler {
 	instances.HandleFunc("/{name}", s.DeleteVMInstanceHandler).Methods(http.MethodDelete)
 	instances.HandleFunc("/{name}", s.UpdateVMInstanceHandler).Methods(http.MethodPut)
 	instances.HandleFunc("/{name}/vnc", s.VNCVMInstanceHandler).Methods(http.MethodGet)
+	instances.HandleFunc("/{name}/console", s.ConsoleVMInstanceHandler).Methods(http.MethodGet)
+	instances.HandleFunc("/{name}/snapshots", s.ListVMSnapshotsHandler).Methods(http.MethodGet)
+	instances.HandleFunc("/{name}/snapshots", s.CreateVMSnapshotHandler).Methods(http.MethodPost)
+	instances.HandleFunc("/{name}/snapshots/{snapshot}", s.GetVMSnapshotHandler).Methods(http.MethodGet)
+	instances.HandleFunc("/{name}/snapshots/{snapshot}", s.DeleteVMSnapshotHandler).Methods(http.MethodDelete)
+	instances.HandleFunc("/{name}/restore", s.RestoreVMInstanceHandler).Methods(http.MethodPost)
+	instances.HandleFunc("/{name}/restores/{restore}", s.GetVMRestoreHandler).Methods(http.MethodGet)
+	instances.HandleFunc("/{name}/{action:start|stop|restart|pause|unpause}", s.PowerVMInstanceHandler).Methods(http.MethodPost)
 
 	return r
 }
@@ -1,7 +1,11 @@
 package server
 
 import (
+	"cloud/internal/clusters"
+	"cloud/internal/vm"
+	"context"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"strconv"
 	"time"
@@ -11,12 +15,39 @@ import (
 
 type Server struct {
 	port int
+	auth *authenticator
 }
 
-func NewServer() *http.Server {
+func NewServer() (*http.Server, error) {
 	port, _ := strconv.Atoi(viper.GetString("service.port"))
+	if viper.IsSet("cluster.timeout") {
+		clusters.OperationTimeout = viper.GetDuration("cluster.timeout")
+	}
+	if viper.GetBool("cluster.cache") {
+		// Reads are served live until the informers have synced, so a
+		// failure here only costs the cache.
+		err := clusters.StartCache(context.Background(), viper.GetString("cluster.vm"), vm.GVKs...)
+		if err != nil {
+			slog.Error("Unable to start the read cache", "error", err.Error())
+		}
+	}
+	// Restores are resumed in the background, as waiting on them would hold
+	// up serving requests.
+	go func() {
+		if err := vm.ResumeRestores(context.Background(), viper.GetString("cluster.vm")); err != nil {
+			slog.Error("Unable to resume restores in progress", "error", err.Error())
+		}
+	}()
+	auth, err := newAuthenticator(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if auth == nil {
+		slog.Warn("Authentication is disabled, every caller has full access")
+	}
 	NewServer := &Server{
 		port: port,
+		auth: auth,
 	}
 
 	// Declare Server config
@@ -28,5 +59,5 @@ func NewServer() *http.Server {
 		WriteTimeout: 30 * time.Second,
 	}
 
-	return server
+	return server, nil
 }
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"cloud/internal/vm"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func (s *Server) ListVMSnapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	crw := customResponseWriter{w: w}
+	project := r.URL.Query().Get("project")
+	if project == "" {
+		crw.error(r, errProjectRequired)
+		return
+	}
+	if err := s.authorize(r, project, permRead); err != nil {
+		crw.error(r, err)
+		return
+	}
+	req := newRequest("vm", r)
+	resource := req.useProject(project)
+	virtualMachine := vm.NewCluster(resource)
+	snapshots, err := virtualMachine.FindSnapshots()
+	if err != nil {
+		crw.error(r, err)
+		return
+	}
+	crw.response(http.StatusOK, "success", snapshots, nil)
+}
+
+func (s *Server) CreateVMSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	crw := customResponseWriter{w: w}
+	project := r.URL.Query().Get("project")
+	if project == "" {
+		crw.error(r, errProjectRequired)
+		return
+	}
+	if err := s.authorize(r, project, permWrite); err != nil {
+		crw.error(r, err)
+		return
+	}
+	req := newRequest("vm", r)
+	resource := req.useProject(project)
+	virtualMachine := vm.NewCluster(resource)
+	snapshot, err := virtualMachine.CreateSnapshot()
+	if err != nil {
+		crw.error(r, err)
+		return
+	}
+	crw.response(http.StatusCreated, "success", snapshot, nil)
+}
+
+func (s *Server) GetVMSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	crw := customResponseWriter{w: w}
+	project := r.URL.Query().Get("project")
+	if project == "" {
+		crw.error(r, errProjectRequired)
+		return
+	}
+	if err := s.authorize(r, project, permRead); err != nil {
+		crw.error(r, err)
+		return
+	}
+	req := newRequest("vm", r)
+	resource := req.useProject(project)
+	virtualMachine := vm.NewCluster(resource)
+	snapshot, err := virtualMachine.FindSnapshot()
+	if err != nil {
+		crw.error(r, err)
+		return
+	}
+	crw.response(http.StatusOK, "success", snapshot, nil)
+}
+
+func (s *Server) DeleteVMSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	crw := customResponseWriter{w: w}
+	project := r.URL.Query().Get("project")
+	if project == "" {
+		crw.error(r, errProjectRequired)
+		return
+	}
+	if err := s.authorize(r, project, permWrite); err != nil {
+		crw.error(r, err)
+		return
+	}
+	req := newRequest("vm", r)
+	resource := req.useProject(project)
+	virtualMachine := vm.NewCluster(resource)
+	err := virtualMachine.DeleteSnapshot()
+	if err != nil {
+		crw.error(r, err)
+		return
+	}
+	crw.response(http.StatusOK, "success", nil, nil)
+}
+
+// maxRestoreWait caps how long RestoreVMInstanceHandler runs for with a
+// "wait" query, counted from the start of the request, to stay within the
+// write timeout of the server.
+const maxRestoreWait = 20 * time.Second
+
+// RestoreVMInstanceHandler restores a virtual machine from one of its
+// snapshots. It replies once the restore is created, or once it completes
+// when given a "wait" query in seconds, with 202 while the restore is still
+// in progress. Progress is followed through GetVMRestoreHandler.
+func (s *Server) RestoreVMInstanceHandler(w http.ResponseWriter, r *http.Request) {
+	deadline := time.Now().Add(maxRestoreWait)
+	crw := customResponseWriter{w: w}
+	project := r.URL.Query().Get("project")
+	if project == "" {
+		crw.error(r, errProjectRequired)
+		return
+	}
+	if err := s.authorize(r, project, permWrite); err != nil {
+		crw.error(r, err)
+		return
+	}
+	var wait time.Duration
+	if value := r.URL.Query().Get("wait"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			crw.error(r, newAPIError(http.StatusBadRequest, "bad_request", "wait must be a non-negative number of seconds"))
+			return
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+	req := newRequest("vm", r)
+	resource := req.useProject(project)
+	virtualMachine := vm.NewCluster(resource)
+	restore, err := virtualMachine.Restore(quotaAdmission(resource))
+	if err != nil {
+		crw.error(r, err)
+		return
+	}
+	// Creating the restore may have taken a while already.
+	wait = min(wait, time.Until(deadline))
+	if wait > 0 {
+		restore, err = virtualMachine.WaitRestore(restore, wait)
+		if err != nil {
+			crw.error(r, err)
+			return
+		}
+	}
+	if !restore.Complete {
+		crw.response(http.StatusAccepted, "in progress", restore, nil)
+		return
+	}
+	crw.response(http.StatusOK, "success", restore, nil)
+}
+
+// GetVMRestoreHandler reports the progress of a restore. Websocket clients
+// are streamed its progress until it completes.
+func (s *Server) GetVMRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	crw := customResponseWriter{w: w}
+	project := r.URL.Query().Get("project")
+	if project == "" {
+		crw.error(r, errProjectRequired)
+		return
+	}
+	if err := s.authorize(r, project, permRead); err != nil {
+		crw.error(r, err)
+		return
+	}
+	// Cancelled by cancelOnClose once the connection is upgraded.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	r = r.WithContext(ctx)
+	req := newRequest("vm", r)
+	resource := req.useProject(project)
+	virtualMachine := vm.NewCluster(resource)
+	restore, err := virtualMachine.FindRestore()
+	if err != nil {
+		crw.error(r, err)
+		return
+	}
+	if !websocket.IsWebSocketUpgrade(r) {
+		crw.response(http.StatusOK, "success", restore, nil)
+		return
+	}
+
+	conn, err := newUpgrader(r).Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already replied to the client.
+		slog.Error(err.Error())
+		return
+	}
+	defer conn.Close()
+	if restore.Complete {
+		writeRestore(conn, restore)
+		closeWebsocket(conn, nil)
+		return
+	}
+	watcher, err := virtualMachine.WatchRestore(restore.Name)
+	if err != nil {
+		closeWebsocket(conn, err)
+		return
+	}
+	defer watcher.Stop()
+
+	cancelOnClose(conn, cancel)
+
+	for event := range watcher.ResultChan() {
+		obj, ok := event.Object.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		restore := vm.NewRestore(obj)
+		if err := writeRestore(conn, restore); err != nil {
+			return
+		}
+		if restore.Complete {
+			break
+		}
+	}
+	closeWebsocket(conn, nil)
+}
+
+// writeRestore sends the progress of a restore to a websocket.
+func writeRestore(conn *websocket.Conn, restore *vm.Restore) error {
+	data, err := json.Marshal(restore)
+	if err != nil {
+		slog.Error(err.Error())
+		return nil
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		slog.Error(err.Error())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"cloud/internal/store"
+	"net/http"
+)
+
+func (s *Server) ListSecretsHandler(w http.ResponseWriter, r *http.Request) {
+	crw := customResponseWriter{w: w}
+	project := r.URL.Query().Get("project")
+	if project == "" {
+		crw.error(r, errProjectRequired)
+		return
+	}
+	if err := s.authorize(r, project, permRead); err != nil {
+		crw.error(r, err)
+		return
+	}
+	req := newRequest("vm", r)
+	resource := req.useProject(project)
+	storage := store.NewCluster(resource)
+	secrets, err := storage.FindSecrets()
+	if err != nil {
+		crw.error(r, err)
+		return
+	}
+	crw.response(http.StatusOK, "success", secrets, nil)
+}
+
+func (s *Server) GetSecretHandler(w http.ResponseWriter, r *http.Request) {
+	crw := customResponseWriter{w: w}
+	project := r.URL.Query().Get("project")
+	if project == "" {
+		crw.error(r, errProjectRequired)
+		return
+	}
+	if err := s.authorize(r, project, permRead); err != nil {
+		crw.error(r, err)
+		return
+	}
+	req := newRequest("vm", r)
+	resource := req.useProject(project)
+	storage := store.NewCluster(resource)
+	secret, err := storage.FindSecret()
+	if err != nil {
+		crw.error(r, err)
+		return
+	}
+	crw.response(http.StatusOK, "success", secret, nil)
+}
+
+func (s *Server) CreateSecretHandler(w http.ResponseWriter, r *http.Request) {
+	crw := customResponseWriter{w: w}
+	project := r.URL.Query().Get("project")
+	if project == "" {
+		crw.error(r, errProjectRequired)
+		return
+	}
+	if err := s.authorize(r, project, permWrite); err != nil {
+		crw.error(r, err)
+		return
+	}
+	req := newRequest("vm", r)
+	resource := req.useProject(project)
+	storage := store.NewCluster(resource)
+	secret, err := storage.CreateSecret()
+	if err != nil {
+		crw.error(r, err)
+		return
+	}
+	crw.response(http.StatusCreated, "success", secret, nil)
+}
+
+func (s *Server) UpdateSecretHandler(w http.ResponseWriter, r *http.Request) {
+	crw := customResponseWriter{w: w}
+	project := r.URL.Query().Get("project")
+	if project == "" {
+		crw.error(r, errProjectRequired)
+		return
+	}
+	if err := s.authorize(r, project, permWrite); err != nil {
+		crw.error(r, err)
+		return
+	}
+	req := newRequest("vm", r)
+	resource := req.useProject(project)
+	storage := store.NewCluster(resource)
+	secret, err := storage.UpdateSecret()
+	if err != nil {
+		crw.error(r, err)
+		return
+	}
+	crw.response(http.StatusOK, "success", secret, nil)
+}
+
+func (s *Server) DeleteSecretHandler(w http.ResponseWriter, r *http.Request) {
+	crw := customResponseWriter{w: w}
+	project := r.URL.Query().Get("project")
+	if project == "" {
+		crw.error(r, errProjectRequired)
+		return
+	}
+	if err := s.authorize(r, project, permWrite); err != nil {
+		crw.error(r, err)
+		return
+	}
+	req := newRequest("vm", r)
+	resource := req.useProject(project)
+	storage := store.NewCluster(resource)
+	err := storage.DeleteSecret()
+	if err != nil {
+		crw.error(r, err)
+		return
+	}
+	crw.response(http.StatusOK, "success", nil, nil)
+}
+
+func (s *Server) ListConfigMapsHandler(w http.ResponseWriter, r *http.Request) {
+	crw := customResponseWriter{w: w}
+	project := r.URL.Query().Get("project")
+	if project == "" {
+		crw.error(r, errProjectRequired)
+		return
+	}
+	if err := s.authorize(r, project, permRead); err != nil {
+		crw.error(r, err)
+		return
+	}
+	req := newRequest("vm", r)
+	resource := req.useProject(project)
+	storage := store.NewCluster(resource)
+	configMaps, err := storage.FindConfigMaps()
+	if err != nil {
+		crw.error(r, err)
+		return
+	}
+	crw.response(http.StatusOK, "success", configMaps, nil)
+}
+
+func (s *Server) GetConfigMapHandler(w http.ResponseWriter, r *http.Request) {
+	crw := customResponseWriter{w: w}
+	project := r.URL.Query().Get("project")
+	if project == "" {
+		crw.error(r, errProjectRequired)
+		return
+	}
+	if err := s.authorize(r, project, permRead); err != nil {
+		crw.error(r, err)
+		return
+	}
+	req := newRequest("vm", r)
+	resource := req.useProject(project)
+	storage := store.NewCluster(resource)
+	configMap, err := storage.FindConfigMap()
+	if err != nil {
+		crw.error(r, err)
+		return
+	}
+	crw.response(http.StatusOK, "success", configMap, nil)
+}
+
+func (s *Server) CreateConfigMapHandler(w http.ResponseWriter, r *http.Request) {
+	crw := customResponseWriter{w: w}
+	project := r.URL.Query().Get("project")
+	if project == "" {
+		crw.error(r, errProjectRequired)
+		return
+	}
+	if err := s.authorize(r, project, permWrite); err != nil {
+		crw.error(r, err)
+		return
+	}
+	req := newRequest("vm", r)
+	resource := req.useProject(project)
+	storage := store.NewCluster(resource)
+	configMap, err := storage.CreateConfigMap()
+	if err != nil {
+		crw.error(r, err)
+		return
+	}
+	crw.response(http.StatusCreated, "success", configMap, nil)
+}
+
+func (s *Server) UpdateConfigMapHandler(w http.ResponseWriter, r *http.Request) {
+	crw := customResponseWriter{w: w}
+	project := r.URL.Query().Get("project")
+	if project == "" {
+		crw.error(r, errProjectRequired)
+		return
+	}
+	if err := s.authorize(r, project, permWrite); err != nil {
+		crw.error(r, err)
+		return
+	}
+	req := newRequest("vm", r)
+	resource := req.useProject(project)
+	storage := store.NewCluster(resource)
+	configMap, err := storage.UpdateConfigMap()
+	if err != nil {
+		crw.error(r, err)
+		return
+	}
+	crw.response(http.StatusOK, "success", configMap, nil)
+}
+
+func (s *Server) DeleteConfigMapHandler(w http.ResponseWriter, r *http.Request) {
+	crw := customResponseWriter{w: w}
+	project := r.URL.Query().Get("project")
+	if project == "" {
+		crw.error(r, errProjectRequired)
+		return
+	}
+	if err := s.authorize(r, project, permWrite); err != nil {
+		crw.error(r, err)
+		return
+	}
+	req := newRequest("vm", r)
+	resource := req.useProject(project)
+	storage := store.NewCluster(resource)
+	err := storage.DeleteConfigMap()
+	if err != nil {
+		crw.error(r, err)
+		return
+	}
+	crw.response(http.StatusOK, "success", nil, nil)
+}
@@ -2,45 +2,48 @@ package server
 
 import (
 	"cloud/internal/vm"
+	"context"
 	"encoding/json"
 	"log/slog"
 	"net/http"
 
 	"github.com/gorilla/websocket"
-	"k8s.io/apimachinery/pkg/api/errors"
+	"github.com/spf13/viper"
 )
 
+var errProjectRequired = newAPIError(http.StatusBadRequest, "project_required", "project is required")
+
 func (s *Server) ListVMInstancesHandler(w http.ResponseWriter, r *http.Request) {
 	crw := customResponseWriter{w: w}
 	project := r.URL.Query().Get("project")
 	if project == "" {
-		crw.response(http.StatusBadRequest, "project is required", nil, nil)
+		crw.error(r, errProjectRequired)
+		return
+	}
+	if err := s.authorize(r, project, permRead); err != nil {
+		crw.error(r, err)
 		return
 	}
 	req := newRequest("vm", r)
 	resource := req.useProject(project)
 	virtualMachine := vm.NewCluster(resource)
-	vms, err := virtualMachine.FindAll()
+	vms, meta, err := virtualMachine.FindAll()
 	if err != nil {
-		statusError, isStatus := err.(*errors.StatusError)
-		if isStatus {
-			errCode := statusError.Status().Code
-			slog.Error("Kubernetes error", "code", errCode, "message", err.Error())
-			crw.response(int(errCode), err.Error(), nil, nil)
-		} else {
-			slog.Error("Unknown error", "message", err.Error())
-			crw.response(http.StatusUnprocessableEntity, err.Error(), nil, nil)
-		}
+		crw.error(r, err)
 		return
 	}
-	crw.response(http.StatusOK, "success", vms, nil)
+	crw.response(http.StatusOK, "success", vms, meta)
 }
 
 func (s *Server) GetVMInstanceHandler(w http.ResponseWriter, r *http.Request) {
 	crw := customResponseWriter{w: w}
 	project := r.URL.Query().Get("project")
 	if project == "" {
-		crw.response(http.StatusBadRequest, "project is required", nil, nil)
+		crw.error(r, errProjectRequired)
+		return
+	}
+	if err := s.authorize(r, project, permRead); err != nil {
+		crw.error(r, err)
 		return
 	}
 	req := newRequest("vm", r)
@@ -48,15 +51,7 @@ func (s *Server) GetVMInstanceHandler(w http.ResponseWriter, r *http.Request) {
 	virtualMachine := vm.NewCluster(resource)
 	vm, err := virtualMachine.Find()
 	if err != nil {
-		statusError, isStatus := err.(*errors.StatusError)
-		if isStatus {
-			errCode := statusError.Status().Code
-			slog.Error("Kubernetes error", "code", errCode, "message", err.Error())
-			crw.response(int(errCode), err.Error(), nil, nil)
-		} else {
-			slog.Error("Unknown error", "message", err.Error())
-			crw.response(http.StatusUnprocessableEntity, err.Error(), nil, nil)
-		}
+		crw.error(r, err)
 		return
 	}
 	crw.response(http.StatusOK, "success", vm, nil)
@@ -66,7 +61,11 @@ func (s *Server) DeleteVMInstanceHandler(w http.ResponseWriter, r *http.Request)
 	crw := customResponseWriter{w: w}
 	project := r.URL.Query().Get("project")
 	if project == "" {
-		crw.response(http.StatusBadRequest, "project is required", nil, nil)
+		crw.error(r, errProjectRequired)
+		return
+	}
+	if err := s.authorize(r, project, permWrite); err != nil {
+		crw.error(r, err)
 		return
 	}
 	req := newRequest("vm", r)
@@ -74,15 +73,7 @@ func (s *Server) DeleteVMInstanceHandler(w http.ResponseWriter, r *http.Request)
 	virtualMachine := vm.NewCluster(resource)
 	err := virtualMachine.Delete()
 	if err != nil {
-		statusError, isStatus := err.(*errors.StatusError)
-		if isStatus {
-			errCode := statusError.Status().Code
-			slog.Error("Kubernetes error", "code", errCode, "message", err.Error())
-			crw.response(int(errCode), err.Error(), nil, nil)
-		} else {
-			slog.Error("Unknown error", "message", err.Error())
-			crw.response(http.StatusUnprocessableEntity, err.Error(), nil, nil)
-		}
+		crw.error(r, err)
 		return
 	}
 	crw.response(http.StatusOK, "success", nil, nil)
@@ -92,59 +83,88 @@ func (s *Server) UpdateVMInstanceHandler(w http.ResponseWriter, r *http.Request)
 	crw := customResponseWriter{w: w}
 	project := r.URL.Query().Get("project")
 	if project == "" {
-		crw.response(http.StatusBadRequest, "project is required", nil, nil)
+		crw.error(r, errProjectRequired)
+		return
+	}
+	if err := s.authorize(r, project, permWrite); err != nil {
+		crw.error(r, err)
 		return
 	}
 	req := newRequest("vm", r)
 	resource := req.useProject(project)
 	virtualMachine := vm.NewCluster(resource)
-	vm, err := virtualMachine.Patch()
+	vm, notes, err := virtualMachine.Patch()
 	if err != nil {
-		statusError, isStatus := err.(*errors.StatusError)
-		if isStatus {
-			errCode := statusError.Status().Code
-			slog.Error("Kubernetes error", "code", errCode, "message", err.Error())
-			crw.response(int(errCode), err.Error(), nil, nil)
-		} else {
-			slog.Error("Unknown error", "message", err.Error())
-			crw.response(http.StatusUnprocessableEntity, err.Error(), nil, nil)
-		}
+		crw.error(r, err)
 		return
 	}
-	crw.response(http.StatusOK, "success", vm, nil)
+	switch {
+	case len(notes.RestartRequired) > 0:
+		crw.response(http.StatusOK, "restart required", vm, notes)
+	case len(notes.ProvisionOnly) > 0:
+		crw.response(http.StatusOK, "success", vm, notes)
+	default:
+		crw.response(http.StatusOK, "success", vm, nil)
+	}
 }
 
 func (s *Server) CreateVMInstanceHandler(w http.ResponseWriter, r *http.Request) {
 	crw := customResponseWriter{w: w}
 	project := r.URL.Query().Get("project")
 	if project == "" {
-		crw.response(http.StatusBadRequest, "project is required", nil, nil)
+		crw.error(r, errProjectRequired)
+		return
+	}
+	if err := s.authorize(r, project, permWrite); err != nil {
+		crw.error(r, err)
 		return
 	}
 	req := newRequest("vm", r)
 	resource := req.useProject(project)
 	virtualMachine := vm.NewCluster(resource)
-	err := virtualMachine.Create()
+	err := virtualMachine.Create(quotaAdmission(resource))
 	if err != nil {
-		statusError, isStatus := err.(*errors.StatusError)
-		if isStatus {
-			errCode := statusError.Status().Code
-			slog.Error("Kubernetes error", "code", errCode, "message", err.Error())
-			crw.response(int(errCode), err.Error(), nil, nil)
-		} else {
-			slog.Error("Unknown error", "message", err.Error())
-			crw.response(http.StatusUnprocessableEntity, err.Error(), nil, nil)
-		}
+		crw.error(r, err)
 		return
 	}
 	crw.response(http.StatusOK, "success", nil, nil)
 }
 
+func (s *Server) PowerVMInstanceHandler(w http.ResponseWriter, r *http.Request) {
+	crw := customResponseWriter{w: w}
+	project := r.URL.Query().Get("project")
+	if project == "" {
+		crw.error(r, errProjectRequired)
+		return
+	}
+	if err := s.authorize(r, project, permPower); err != nil {
+		crw.error(r, err)
+		return
+	}
+	req := newRequest("vm", r)
+	resource := req.useProject(project)
+	virtualMachine := vm.NewCluster(resource)
+	state, err := virtualMachine.Power()
+	if err != nil {
+		crw.error(r, err)
+		return
+	}
+	if !state.Complete {
+		crw.response(http.StatusAccepted, "in progress", state, nil)
+		return
+	}
+	crw.response(http.StatusOK, "success", state, nil)
+}
+
 func (s *Server) VNCVMInstanceHandler(w http.ResponseWriter, r *http.Request) {
 	crw := customResponseWriter{w: w}
 	project := r.URL.Query().Get("project")
 	if project == "" {
-		crw.response(http.StatusBadRequest, "project is required", nil, nil)
+		crw.error(r, errProjectRequired)
+		return
+	}
+	if err := s.authorize(r, project, permConsole); err != nil {
+		crw.error(r, err)
 		return
 	}
 	req := newRequest("vm", r)
@@ -152,110 +172,112 @@ func (s *Server) VNCVMInstanceHandler(w http.ResponseWriter, r *http.Request) {
 	virtualMachine := vm.NewCluster(resource)
 	vmInstance, err := virtualMachine.VNC()
 	if err != nil {
-		statusError, isStatus := err.(*errors.StatusError)
-		if isStatus {
-			errCode := statusError.Status().Code
-			slog.Error("Kubernetes error", "code", errCode, "message", err.Error())
-			crw.response(int(errCode), err.Error(), nil, nil)
-		} else {
-			slog.Error("Unknown error", "message", err.Error())
-			crw.response(http.StatusUnprocessableEntity, err.Error(), nil, nil)
-		}
+		crw.error(r, err)
 		return
 	}
 	// Upgrade HTTP connection to WebSocket
-	upgrader := websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
-	}
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := newUpgrader(r).Upgrade(w, r, nil)
 	if err != nil {
+		// The upgrader has already replied to the client.
 		slog.Error(err.Error())
-		crw.response(http.StatusInternalServerError, err.Error(), nil, nil)
 		return
 	}
+	defer conn.Close()
 
-	vmiConn := vmInstance.AsConn()
-	// Start copying data between WebSocket and VMI console
-	go func() {
-		for {
-			_, message, err := conn.ReadMessage()
-			if err != nil {
-				slog.Error("Error reading from websocket: " + err.Error())
-				break
-			}
-			_, err = vmiConn.Write(message)
-			if err != nil {
-				slog.Error("Error writing to VMI console: n" + err.Error())
-				break
-			}
-		}
-	}()
+	proxyStream(conn, vmInstance.AsConn(), websocket.BinaryMessage)
+}
 
-	buf := make([]byte, 1024)
-	for {
-		n, err := vmiConn.Read(buf)
-		if err != nil {
-			slog.Error("Error reading from VMI console: " + err.Error())
-			break
-		}
-		err = conn.WriteMessage(websocket.BinaryMessage, buf[:n])
-		if err != nil {
-			slog.Error("Error writing to websocket: " + err.Error())
-			break
-		}
+// ConsoleVMInstanceHandler bridges the serial console of a running virtual
+// machine to a websocket. Output is sent in binary frames unless the
+// "frames=text" query is given, which suits xterm.js clients, and the
+// "timeout" query overrides the configured connect timeout in seconds.
+func (s *Server) ConsoleVMInstanceHandler(w http.ResponseWriter, r *http.Request) {
+	crw := customResponseWriter{w: w}
+	project := r.URL.Query().Get("project")
+	if project == "" {
+		crw.error(r, errProjectRequired)
+		return
+	}
+	if err := s.authorize(r, project, permConsole); err != nil {
+		crw.error(r, err)
+		return
+	}
+	messageType := websocket.BinaryMessage
+	switch r.URL.Query().Get("frames") {
+	case "", "binary":
+	case "text":
+		messageType = websocket.TextMessage
+	default:
+		crw.error(r, newAPIError(http.StatusBadRequest, "bad_request", "frames must be text or binary"))
+		return
 	}
+	req := newRequest("vm", r)
+	resource := req.useProject(project)
+	virtualMachine := vm.NewCluster(resource)
+	vmInstance, err := virtualMachine.Console(viper.GetDuration("cluster.console_timeout"))
+	if err != nil {
+		crw.error(r, err)
+		return
+	}
+	// Upgrade HTTP connection to WebSocket
+	conn, err := newUpgrader(r).Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already replied to the client.
+		slog.Error(err.Error())
+		return
+	}
+	defer conn.Close()
+
+	proxyStream(conn, vmInstance.AsConn(), messageType)
 }
 
 func (s *Server) WatchVMInstanceHandler(w http.ResponseWriter, r *http.Request) {
 	crw := customResponseWriter{w: w}
 	project := r.URL.Query().Get("project")
 	if project == "" {
-		crw.response(http.StatusBadRequest, "project is required", nil, nil)
+		crw.error(r, errProjectRequired)
+		return
+	}
+	if err := s.authorize(r, project, permRead); err != nil {
+		crw.error(r, err)
 		return
 	}
+	// Cancelled by cancelOnClose once the connection is upgraded.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	r = r.WithContext(ctx)
 	req := newRequest("vm", r)
 	resource := req.useProject(project)
 	virtualMachine := vm.NewCluster(resource)
 	// Upgrade HTTP connection to WebSocket
-	upgrader := websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
-	}
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := newUpgrader(r).Upgrade(w, r, nil)
 	if err != nil {
+		// The upgrader has already replied to the client.
 		slog.Error(err.Error())
-		crw.response(http.StatusInternalServerError, err.Error(), nil, nil)
 		return
 	}
+	defer conn.Close()
 
 	watcher, err := virtualMachine.Watch()
 	if err != nil {
-		statusError, isStatus := err.(*errors.StatusError)
-		if isStatus {
-			errCode := statusError.Status().Code
-			slog.Error("Kubernetes error", "code", errCode, "message", err.Error())
-			crw.response(int(errCode), err.Error(), nil, nil)
-		} else {
-			slog.Error("Unknown error", "message", err.Error())
-			crw.response(http.StatusUnprocessableEntity, err.Error(), nil, nil)
-		}
+		closeWebsocket(conn, err)
 		return
 	}
 	defer watcher.Stop()
 
+	cancelOnClose(conn, cancel)
+
 	// Stream events to the websocket
 	for event := range watcher.ResultChan() {
-		jsonData, err := json.Marshal(event)
+		jsonData, err := json.Marshal(vm.NewEvent(event))
 		if err != nil {
 			slog.Error(err.Error())
 			continue
 		}
 		if err := conn.WriteMessage(websocket.TextMessage, jsonData); err != nil {
 			slog.Error(err.Error())
-			break
+			return
 		}
 	}
+	closeWebsocket(conn, nil)
 }
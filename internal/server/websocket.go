@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// maxCloseReason is the longest reason that fits in a close frame
+	// payload.
+	maxCloseReason = 123
+	// websocketProtocol is the subprotocol browser clients offer next to the
+	// one carrying their token, so that the server has a subprotocol to agree
+	// to without echoing the token back.
+	websocketProtocol = "anvil"
+)
+
+// newUpgrader returns an upgrader that accepts any origin and agrees to the
+// first subprotocol offered by the client, other than one carrying a token.
+func newUpgrader(r *http.Request) *websocket.Upgrader {
+	protocols := []string{}
+	for _, protocol := range websocket.Subprotocols(r) {
+		if !strings.HasPrefix(protocol, tokenSubprotocolPrefix) {
+			protocols = append(protocols, protocol)
+		}
+	}
+	return &websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+		Subprotocols: protocols,
+	}
+}
+
+// tokenOnlySubprotocol reports whether a websocket request authenticates
+// with a token subprotocol without offering any other subprotocol. Browsers
+// fail the connection when the server agrees to none of the subprotocols
+// they offered, and the token is never agreed to.
+func tokenOnlySubprotocol(r *http.Request) bool {
+	protocols := websocket.Subprotocols(r)
+	if len(protocols) == 0 {
+		return false
+	}
+	for _, protocol := range protocols {
+		if !strings.HasPrefix(protocol, tokenSubprotocolPrefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// closeWebsocket sends a close frame describing err to the client, or a
+// normal closure when err is nil.
+func closeWebsocket(conn *websocket.Conn, err error) {
+	code := websocket.CloseNormalClosure
+	reason := ""
+	if err != nil {
+		apiErr := toAPIError(err)
+		code = websocket.CloseInternalServerErr
+		if apiErr.status < http.StatusInternalServerError {
+			code = websocket.ClosePolicyViolation
+		}
+		reason = apiErr.Code + ": " + apiErr.Message
+		slog.Error("Closing websocket", "code", code, "message", err.Error())
+	}
+	if len(reason) > maxCloseReason {
+		reason = reason[:maxCloseReason]
+	}
+	message := websocket.FormatCloseMessage(code, reason)
+	_ = conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+}
+
+// cancelOnClose calls cancel once the client of a websocket goes away. The
+// request context outlives a hijacked connection, so handlers streaming to a
+// websocket cancel their own context with it. Control frames are only
+// processed while reading, and a failed read means the client has gone
+// away.
+func cancelOnClose(conn *websocket.Conn, cancel context.CancelFunc) {
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				cancel()
+				return
+			}
+		}
+	}()
+}
+
+// proxyStream copies data in both directions between a websocket and a
+// virtual machine stream such as VNC or the serial console, until either
+// side fails. Output is written in frames of the given message type.
+func proxyStream(conn *websocket.Conn, stream net.Conn, messageType int) {
+	defer stream.Close()
+	go func() {
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				slog.Error("Error reading from websocket: " + err.Error())
+				stream.Close()
+				return
+			}
+			_, err = stream.Write(message)
+			if err != nil {
+				slog.Error("Error writing to VMI stream: " + err.Error())
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 1024)
+	// pending holds the start of a multi-byte character split across reads,
+	// since text frames must carry valid UTF-8.
+	pending := 0
+	for {
+		n, err := stream.Read(buf[pending:])
+		if err != nil {
+			slog.Error("Error reading from VMI stream: " + err.Error())
+			break
+		}
+		n += pending
+		out := buf[:n]
+		pending = 0
+		if messageType == websocket.TextMessage {
+			out, pending = splitIncompleteRune(out)
+		}
+		if len(out) > 0 {
+			err = conn.WriteMessage(messageType, out)
+			if err != nil {
+				slog.Error("Error writing to websocket: " + err.Error())
+				return
+			}
+		}
+		copy(buf, buf[n-pending:n])
+	}
+	closeWebsocket(conn, nil)
+}
+
+// splitIncompleteRune separates a trailing, incomplete UTF-8 sequence from
+// data, returning the complete prefix and the length of the remainder.
+func splitIncompleteRune(data []byte) ([]byte, int) {
+	for i := 1; i < utf8.UTFMax && i <= len(data); i++ {
+		start := len(data) - i
+		if !utf8.RuneStart(data[start]) {
+			continue
+		}
+		if !utf8.FullRune(data[start:]) {
+			return data[:start], i
+		}
+		break
+	}
+	return data, 0
+}
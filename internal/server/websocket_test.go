@@ -0,0 +1,82 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gorilla/websocket"
+)
+
+func TestWebsocketTokenSubprotocol(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &authenticator{verifier: oidc.NewVerifier(testIssuer, &oidc.StaticKeySet{
+		PublicKeys: []crypto.PublicKey{key.Public()},
+	}, &oidc.Config{SkipClientIDCheck: true})}
+	server := httptest.NewServer(requestIDMiddleware(auth.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := newUpgrader(r).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		closeWebsocket(conn, nil)
+		conn.Close()
+	}))))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	token := tokenSubprotocolPrefix + signToken(t, key, map[string]interface{}{
+		"iss": testIssuer,
+		"sub": "user-1",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+
+	dialer := websocket.Dialer{Subprotocols: []string{token}}
+	conn, resp, err := dialer.Dial(url, nil)
+	if err == nil {
+		conn.Close()
+		t.Fatal("expected the handshake offering only the token to fail")
+	}
+	if resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %+v", http.StatusBadRequest, resp)
+	}
+
+	dialer = websocket.Dialer{Subprotocols: []string{websocketProtocol, token}}
+	conn, _, err = dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.Subprotocol() != websocketProtocol {
+		t.Errorf("expected the %q subprotocol to be agreed to, got %q", websocketProtocol, conn.Subprotocol())
+	}
+}
+
+func TestSplitIncompleteRune(t *testing.T) {
+	euro := []byte("€") // three bytes
+	tests := []struct {
+		data     []byte
+		complete string
+		pending  int
+	}{
+		{[]byte("login:"), "login:", 0},
+		{append([]byte("a"), euro...), "a€", 0},
+		{append([]byte("a"), euro[:1]...), "a", 1},
+		{append([]byte("a"), euro[:2]...), "a", 2},
+		{euro[:2], "", 2},
+	}
+	for _, test := range tests {
+		complete, pending := splitIncompleteRune(test.data)
+		if string(complete) != test.complete || pending != test.pending {
+			t.Errorf("splitIncompleteRune(%q) = %q, %d; want %q, %d", test.data, complete, pending, test.complete, test.pending)
+		}
+	}
+}
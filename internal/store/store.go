@@ -0,0 +1,369 @@
+// Package store keeps the secrets and config maps of a project, such as
+// cloud-init payloads, SSH keys and credentials used by virtual machines.
+package store
+
+import (
+	"cloud/internal/clusters"
+	"cloud/internal/clusters/k8s"
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// managedLabel marks the objects created through the API. Other objects of
+// the project namespace, such as service account tokens, are left alone.
+const managedLabel = "app.kubernetes.io/managed-by"
+
+const managedBy = "anvil"
+
+// secretTypes are the types secrets can be created with. Other types are
+// interpreted by the cluster, such as service account tokens it fills in.
+var secretTypes = []string{string(corev1.SecretTypeOpaque)}
+
+// Payload is the request body of creating or replacing a secret or config
+// map. Values are given as plain text.
+type Payload struct {
+	Name   string            `json:"name,omitempty"`
+	Type   string            `json:"type,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Data   map[string]string `json:"data,omitempty"`
+}
+
+// Secret is the representation of a secret returned to clients. Values are
+// never returned, only the keys they are stored under.
+type Secret struct {
+	Name    string            `json:"name"`
+	Type    string            `json:"type"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Keys    []string          `json:"keys"`
+	Created time.Time         `json:"created"`
+}
+
+// ConfigMap is the representation of a config map returned to clients.
+type ConfigMap struct {
+	Name    string            `json:"name"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Data    map[string]string `json:"data"`
+	Created time.Time         `json:"created"`
+}
+
+func newSecret(secret *corev1.Secret) *Secret {
+	keys := []string{}
+	for key := range secret.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return &Secret{
+		Name:    secret.Name,
+		Type:    string(secret.Type),
+		Labels:  userLabels(secret.Labels),
+		Keys:    keys,
+		Created: secret.CreationTimestamp.Time,
+	}
+}
+
+func newConfigMap(configMap *corev1.ConfigMap) *ConfigMap {
+	data := configMap.Data
+	if data == nil {
+		data = map[string]string{}
+	}
+	return &ConfigMap{
+		Name:    configMap.Name,
+		Labels:  userLabels(configMap.Labels),
+		Data:    data,
+		Created: configMap.CreationTimestamp.Time,
+	}
+}
+
+type Store struct {
+	ctx        context.Context
+	kubeconfig string
+	project    string
+	request    *http.Request
+}
+
+func NewCluster(req clusters.Resource) *Store {
+	return &Store{
+		ctx:        req.Ctx,
+		kubeconfig: req.Kubeconfig,
+		project:    req.Project,
+		request:    req.Request,
+	}
+}
+
+func (s *Store) FindSecrets() ([]*Secret, error) {
+	ctx, cancel := clusters.WithTimeout(s.ctx)
+	defer cancel()
+	list, err := k8s.NewResource(s.kubeconfig).Secrets(ctx, s.project, managedListOptions())
+	if err != nil {
+		return nil, err
+	}
+	secrets := []*Secret{}
+	for i := range list.Items {
+		secrets = append(secrets, newSecret(&list.Items[i]))
+	}
+	return secrets, nil
+}
+
+func (s *Store) FindSecret() (*Secret, error) {
+	secret, err := s.managedSecret(mux.Vars(s.request)["name"])
+	if err != nil {
+		return nil, err
+	}
+	return newSecret(secret), nil
+}
+
+func (s *Store) CreateSecret() (*Secret, error) {
+	payload, err := s.payload(true)
+	if err != nil {
+		return nil, err
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      payload.Name,
+			Namespace: s.project,
+			Labels:    managedLabels(payload.Labels),
+		},
+		Type:       corev1.SecretType(payload.Type),
+		StringData: payload.Data,
+	}
+	if secret.Type == "" {
+		secret.Type = corev1.SecretTypeOpaque
+	}
+	ctx, cancel := clusters.WithTimeout(s.ctx)
+	defer cancel()
+	secret, err = k8s.NewResource(s.kubeconfig).CreateSecret(ctx, secret)
+	if err != nil {
+		return nil, err
+	}
+	return newSecret(secret), nil
+}
+
+// UpdateSecret replaces the labels and data of a secret. Its type cannot be
+// changed.
+func (s *Store) UpdateSecret() (*Secret, error) {
+	payload, err := s.payload(false)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := s.managedSecret(mux.Vars(s.request)["name"])
+	if err != nil {
+		return nil, err
+	}
+	secret.Labels = managedLabels(payload.Labels)
+	secret.Data = nil
+	secret.StringData = payload.Data
+	ctx, cancel := clusters.WithTimeout(s.ctx)
+	defer cancel()
+	secret, err = k8s.NewResource(s.kubeconfig).UpdateSecret(ctx, secret)
+	if err != nil {
+		return nil, err
+	}
+	return newSecret(secret), nil
+}
+
+func (s *Store) DeleteSecret() error {
+	secret, err := s.managedSecret(mux.Vars(s.request)["name"])
+	if err != nil {
+		return err
+	}
+	ctx, cancel := clusters.WithTimeout(s.ctx)
+	defer cancel()
+	return k8s.NewResource(s.kubeconfig).DeleteSecret(ctx, s.project, secret.Name)
+}
+
+func (s *Store) FindConfigMaps() ([]*ConfigMap, error) {
+	ctx, cancel := clusters.WithTimeout(s.ctx)
+	defer cancel()
+	list, err := k8s.NewResource(s.kubeconfig).ConfigMaps(ctx, s.project, managedListOptions())
+	if err != nil {
+		return nil, err
+	}
+	configMaps := []*ConfigMap{}
+	for i := range list.Items {
+		configMaps = append(configMaps, newConfigMap(&list.Items[i]))
+	}
+	return configMaps, nil
+}
+
+func (s *Store) FindConfigMap() (*ConfigMap, error) {
+	configMap, err := s.managedConfigMap(mux.Vars(s.request)["name"])
+	if err != nil {
+		return nil, err
+	}
+	return newConfigMap(configMap), nil
+}
+
+func (s *Store) CreateConfigMap() (*ConfigMap, error) {
+	payload, err := s.payload(true)
+	if err != nil {
+		return nil, err
+	}
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      payload.Name,
+			Namespace: s.project,
+			Labels:    managedLabels(payload.Labels),
+		},
+		Data: payload.Data,
+	}
+	ctx, cancel := clusters.WithTimeout(s.ctx)
+	defer cancel()
+	configMap, err = k8s.NewResource(s.kubeconfig).CreateConfigMap(ctx, configMap)
+	if err != nil {
+		return nil, err
+	}
+	return newConfigMap(configMap), nil
+}
+
+// UpdateConfigMap replaces the labels and data of a config map.
+func (s *Store) UpdateConfigMap() (*ConfigMap, error) {
+	payload, err := s.payload(false)
+	if err != nil {
+		return nil, err
+	}
+	configMap, err := s.managedConfigMap(mux.Vars(s.request)["name"])
+	if err != nil {
+		return nil, err
+	}
+	configMap.Labels = managedLabels(payload.Labels)
+	configMap.Data = payload.Data
+	configMap.BinaryData = nil
+	ctx, cancel := clusters.WithTimeout(s.ctx)
+	defer cancel()
+	configMap, err = k8s.NewResource(s.kubeconfig).UpdateConfigMap(ctx, configMap)
+	if err != nil {
+		return nil, err
+	}
+	return newConfigMap(configMap), nil
+}
+
+func (s *Store) DeleteConfigMap() error {
+	configMap, err := s.managedConfigMap(mux.Vars(s.request)["name"])
+	if err != nil {
+		return err
+	}
+	ctx, cancel := clusters.WithTimeout(s.ctx)
+	defer cancel()
+	return k8s.NewResource(s.kubeconfig).DeleteConfigMap(ctx, s.project, configMap.Name)
+}
+
+// managedSecret gets a secret created through the API, reporting any other
+// secret as not found.
+func (s *Store) managedSecret(name string) (*corev1.Secret, error) {
+	ctx, cancel := clusters.WithTimeout(s.ctx)
+	defer cancel()
+	secret, err := k8s.NewResource(s.kubeconfig).Secret(ctx, s.project, name)
+	if err != nil {
+		return nil, err
+	}
+	if !Managed(secret.Labels) {
+		return nil, k8serrors.NewNotFound(corev1.Resource("secrets"), name)
+	}
+	return secret, nil
+}
+
+// managedConfigMap gets a config map created through the API, reporting
+// any other config map as not found.
+func (s *Store) managedConfigMap(name string) (*corev1.ConfigMap, error) {
+	ctx, cancel := clusters.WithTimeout(s.ctx)
+	defer cancel()
+	configMap, err := k8s.NewResource(s.kubeconfig).ConfigMap(ctx, s.project, name)
+	if err != nil {
+		return nil, err
+	}
+	if !Managed(configMap.Labels) {
+		return nil, k8serrors.NewNotFound(corev1.Resource("configmaps"), name)
+	}
+	return configMap, nil
+}
+
+// payload decodes and validates the request body. The name is only read
+// when creating, it is taken from the path otherwise.
+func (s *Store) payload(create bool) (Payload, error) {
+	payload := Payload{}
+	if err := json.NewDecoder(s.request.Body).Decode(&payload); err != nil {
+		return payload, err
+	}
+	return payload, clusters.NewValidationError(payload.validate(create))
+}
+
+func (p Payload) validate(create bool) field.ErrorList {
+	errs := field.ErrorList{}
+	if create {
+		name := field.NewPath("name")
+		if p.Name == "" {
+			errs = append(errs, field.Required(name, ""))
+		} else {
+			for _, msg := range validation.IsDNS1123Subdomain(p.Name) {
+				errs = append(errs, field.Invalid(name, p.Name, msg))
+			}
+		}
+	}
+	if p.Type != "" && !slices.Contains(secretTypes, p.Type) {
+		errs = append(errs, field.NotSupported(field.NewPath("type"), p.Type, secretTypes))
+	}
+	for key := range p.Data {
+		for _, msg := range validation.IsConfigMapKey(key) {
+			errs = append(errs, field.Invalid(field.NewPath("data").Key(key), key, msg))
+		}
+	}
+	labels := field.NewPath("labels")
+	for key, value := range p.Labels {
+		if key == managedLabel {
+			errs = append(errs, field.Forbidden(labels.Key(key), "the label is reserved"))
+			continue
+		}
+		for _, msg := range validation.IsQualifiedName(key) {
+			errs = append(errs, field.Invalid(labels.Key(key), key, msg))
+		}
+		for _, msg := range validation.IsValidLabelValue(value) {
+			errs = append(errs, field.Invalid(labels.Key(key), value, msg))
+		}
+	}
+	return errs
+}
+
+// Managed reports whether an object carrying labels was created through the
+// API, which is what virtual machines may reference.
+func Managed(labels map[string]string) bool {
+	return labels[managedLabel] == managedBy
+}
+
+func managedListOptions() metav1.ListOptions {
+	return metav1.ListOptions{LabelSelector: managedLabel + "=" + managedBy}
+}
+
+// managedLabels adds the label marking objects created through the API to
+// the labels given by the client.
+func managedLabels(labels map[string]string) map[string]string {
+	managed := map[string]string{managedLabel: managedBy}
+	for key, value := range labels {
+		managed[key] = value
+	}
+	return managed
+}
+
+// userLabels drops the label marking objects created through the API.
+func userLabels(labels map[string]string) map[string]string {
+	user := map[string]string{}
+	for key, value := range labels {
+		if key != managedLabel {
+			user[key] = value
+		}
+	}
+	if len(user) == 0 {
+		return nil
+	}
+	return user
+}
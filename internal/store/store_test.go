@@ -0,0 +1,53 @@
+package store
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSecretValuesAreWriteOnly(t *testing.T) {
+	secret := newSecret(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "db",
+			Labels: managedLabels(map[string]string{"app": "db"}),
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{"password": []byte("hunter2"), "user": []byte("admin")},
+	})
+	data, err := json.Marshal(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "hunter2") {
+		t.Errorf("expected secret values to be left out, got %s", data)
+	}
+	if len(secret.Keys) != 2 || secret.Keys[0] != "password" {
+		t.Errorf("unexpected keys %v", secret.Keys)
+	}
+	if _, ok := secret.Labels[managedLabel]; ok || secret.Labels["app"] != "db" {
+		t.Errorf("unexpected labels %v", secret.Labels)
+	}
+}
+
+func TestPayloadValidate(t *testing.T) {
+	valid := Payload{Name: "cloud-init", Data: map[string]string{"userdata": "#cloud-config"}}
+	if errs := valid.validate(true); len(errs) > 0 {
+		t.Errorf("expected a valid payload, got %v", errs)
+	}
+	invalid := Payload{
+		Name:   "Not_Valid",
+		Labels: map[string]string{managedLabel: "me"},
+		Type:   string(corev1.SecretTypeServiceAccountToken),
+		Data:   map[string]string{"bad key": "x"},
+	}
+	if errs := invalid.validate(true); len(errs) != 4 {
+		t.Errorf("expected 4 errors, got %v", errs)
+	}
+	if errs := (Payload{}).validate(false); len(errs) > 0 {
+		t.Errorf("expected the name to be optional on updates, got %v", errs)
+	}
+}
@@ -0,0 +1,422 @@
+package vm
+
+import (
+	"cloud/internal/clusters"
+	"cloud/internal/clusters/k8s"
+	"cloud/internal/store"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	pathpkg "path"
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/yaml"
+)
+
+const cloudConfigHeader = "#cloud-config\n"
+
+const (
+	// userDataKey is the key of the user data in the Secrets it is
+	// generated into.
+	userDataKey = "userdata"
+	// userDataLabel marks the Secrets generated user data is kept in with
+	// the name of their virtual machine.
+	userDataLabel = "anvil.io/user-data-for"
+)
+
+var (
+	// userNamePattern matches the portable user names accepted by useradd.
+	userNamePattern    = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+	hostnamePattern    = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+	timezonePattern    = regexp.MustCompile(`^[A-Za-z0-9_+-]+(/[A-Za-z0-9_+-]+)*$`)
+	permissionsPattern = regexp.MustCompile(`^0?[0-7]{3,4}$`)
+)
+
+// cloudConfig is the subset of the cloud-config format rendered for virtual
+// machines. It is marshalled rather than templated so that no user supplied
+// value can alter the structure of the document.
+type cloudConfig struct {
+	Hostname   string      `json:"hostname,omitempty"`
+	Timezone   string      `json:"timezone,omitempty"`
+	Users      []cloudUser `json:"users"`
+	SSHPwauth  bool        `json:"ssh_pwauth"`
+	Packages   []string    `json:"packages,omitempty"`
+	WriteFiles []writeFile `json:"write_files,omitempty"`
+	RunCmd     []string    `json:"runcmd,omitempty"`
+}
+
+type cloudUser struct {
+	Name              string   `json:"name"`
+	Sudo              string   `json:"sudo,omitempty"`
+	Groups            string   `json:"groups,omitempty"`
+	Home              string   `json:"home,omitempty"`
+	Shell             string   `json:"shell,omitempty"`
+	LockPasswd        bool     `json:"lock_passwd"`
+	PlainTextPasswd   string   `json:"plain_text_passwd,omitempty"`
+	SSHAuthorizedKeys []string `json:"ssh_authorized_keys,omitempty"`
+}
+
+type writeFile struct {
+	Path        string `json:"path"`
+	Content     string `json:"content"`
+	Encoding    string `json:"encoding,omitempty"`
+	Owner       string `json:"owner,omitempty"`
+	Permissions string `json:"permissions,omitempty"`
+	Append      bool   `json:"append,omitempty"`
+}
+
+// newCloudConfig builds the cloud-config for a create payload. The payload
+// user is created with sudo rights and the compute SSH keys, followed by
+// any extra users.
+func newCloudConfig(payload clusters.ResourceDetails) *cloudConfig {
+	owner := payload.User
+	owner.Sudo = true
+	owner.SSHKeys = append(payload.Compute.AuthorizedKeys(), owner.SSHKeys...)
+	config := &cloudConfig{
+		Hostname: payload.CloudInit.Hostname,
+		Timezone: payload.CloudInit.Timezone,
+		Packages: payload.CloudInit.Packages,
+		RunCmd:   payload.CloudInit.RunCmd,
+	}
+	for _, user := range append([]clusters.User{owner}, payload.CloudInit.Users...) {
+		config.Users = append(config.Users, newCloudUser(user))
+		// Password login is only enabled when a password is supplied.
+		if user.Password != "" {
+			config.SSHPwauth = true
+		}
+	}
+	for _, file := range payload.CloudInit.WriteFiles {
+		config.WriteFiles = append(config.WriteFiles, writeFile(file))
+	}
+	return config
+}
+
+func newCloudUser(user clusters.User) cloudUser {
+	u := cloudUser{
+		Name:              user.Name,
+		Groups:            "users",
+		Home:              "/home/" + user.Name,
+		Shell:             "/bin/bash",
+		LockPasswd:        user.Password == "",
+		PlainTextPasswd:   user.Password,
+		SSHAuthorizedKeys: user.SSHKeys,
+	}
+	if user.Sudo {
+		u.Sudo = "ALL=(ALL) NOPASSWD:ALL"
+	}
+	return u
+}
+
+// validate reports every problem with the config.
+func (c *cloudConfig) validate() field.ErrorList {
+	errs := field.ErrorList{}
+	cloudInit := field.NewPath("cloud_init")
+	if c.Hostname != "" && !hostnamePattern.MatchString(c.Hostname) {
+		errs = append(errs, field.Invalid(cloudInit.Child("hostname"), c.Hostname, "must be a valid hostname"))
+	}
+	if c.Timezone != "" && !timezonePattern.MatchString(c.Timezone) {
+		errs = append(errs, field.Invalid(cloudInit.Child("timezone"), c.Timezone, "must be a timezone such as Africa/Lusaka"))
+	}
+	names := map[string]bool{}
+	for i, user := range c.Users {
+		path := field.NewPath("user")
+		if i > 0 {
+			path = cloudInit.Child("users").Index(i - 1)
+		}
+		if !userNamePattern.MatchString(user.Name) {
+			errs = append(errs, field.Invalid(path.Child("name"), user.Name, "must be a valid user name"))
+		} else if names[user.Name] {
+			errs = append(errs, field.Duplicate(path.Child("name"), user.Name))
+		}
+		names[user.Name] = true
+		if strings.ContainsAny(user.PlainTextPasswd, "\r\n") {
+			errs = append(errs, field.Invalid(path.Child("password"), "", "must not contain line breaks"))
+		}
+		if user.PlainTextPasswd == "" && len(user.SSHAuthorizedKeys) == 0 {
+			errs = append(errs, field.Required(path, "either a password or an ssh key is required"))
+		}
+		for _, key := range user.SSHAuthorizedKeys {
+			if strings.ContainsAny(key, "\r\n") || len(strings.Fields(key)) < 2 {
+				errs = append(errs, field.Invalid(path.Child("ssh_keys"), key, "must be an OpenSSH public key"))
+				break
+			}
+		}
+	}
+	for i, file := range c.WriteFiles {
+		path := cloudInit.Child("write_files").Index(i)
+		if !pathpkg.IsAbs(file.Path) || pathpkg.Clean(file.Path) != file.Path {
+			errs = append(errs, field.Invalid(path.Child("path"), file.Path, "must be a clean absolute path"))
+		}
+		switch file.Encoding {
+		case "", "b64", "base64", "gzip", "gz", "gz+b64", "gzip+base64", "text/plain":
+		default:
+			errs = append(errs, field.NotSupported(path.Child("encoding"), file.Encoding, []string{"b64", "gzip", "gz+b64", "text/plain"}))
+		}
+		if file.Permissions != "" && !permissionsPattern.MatchString(file.Permissions) {
+			errs = append(errs, field.Invalid(path.Child("permissions"), file.Permissions, "must be an octal mode"))
+		}
+	}
+	for i, pkg := range c.Packages {
+		if pkg == "" || strings.ContainsAny(pkg, " \t\r\n") {
+			errs = append(errs, field.Invalid(cloudInit.Child("packages").Index(i), pkg, "must be a package name"))
+		}
+	}
+	return errs
+}
+
+// render validates the config and marshals it into a cloud-config document.
+func (c *cloudConfig) render() ([]byte, error) {
+	if err := clusters.NewValidationError(c.validate()); err != nil {
+		return nil, err
+	}
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	// Parsing the document back guards against anything the marshaller
+	// produced that cloud-init would read differently.
+	var parsed cloudConfig
+	if err := yaml.UnmarshalStrict(data, &parsed); err != nil {
+		return nil, err
+	}
+	if len(parsed.Users) != len(c.Users) {
+		return nil, errors.New("rendered cloud-config does not round trip")
+	}
+	return append([]byte(cloudConfigHeader), data...), nil
+}
+
+// cloudInitSource returns the source of the cloud-init disk found in
+// volumes.
+func cloudInitSource(volumes []interface{}) (map[string]interface{}, error) {
+	for _, volume := range volumes {
+		v, ok := volume.(map[string]interface{})
+		if !ok || v["name"] != "cloudinitdisk" {
+			continue
+		}
+		source, ok := v["cloudInitNoCloud"].(map[string]interface{})
+		if !ok {
+			source, ok = v["cloudInitConfigDrive"].(map[string]interface{})
+		}
+		if ok {
+			return source, nil
+		}
+	}
+	return nil, k8serrors.NewBadRequest("ssh keys cannot be updated, the virtual machine has no cloud-init disk")
+}
+
+// setCloudInitSSHKeys rewrites the user data of the cloud-init disk found in
+// volumes so that its first user is authorised with the given public keys.
+// User data generated into a Secret is rewritten there instead, and the
+// Secret is returned to be updated.
+func (vm *VirtualMachine) setCloudInitSSHKeys(name string, volumes []interface{}, sshKeys []string) (*corev1.Secret, error) {
+	source, err := cloudInitSource(volumes)
+	if err != nil {
+		return nil, err
+	}
+	if ref, ok := source["userDataSecretRef"].(map[string]interface{}); ok {
+		secretName, _ := ref["name"].(string)
+		ctx, cancel := clusters.WithTimeout(vm.ctx)
+		defer cancel()
+		secret, err := k8s.NewResource(vm.kubeconfig).Secret(ctx, vm.project, secretName)
+		if err != nil {
+			return nil, err
+		}
+		if secret.Labels[userDataLabel] != name {
+			return nil, k8serrors.NewBadRequest("ssh keys can only be updated on generated user data")
+		}
+		userData, err := setSSHKeys(secret.Data[userDataKey], sshKeys)
+		if err != nil {
+			return nil, err
+		}
+		secret.Data[userDataKey] = userData
+		return secret, nil
+	}
+	encoded, ok := source["userDataBase64"].(string)
+	if !ok {
+		return nil, k8serrors.NewBadRequest("ssh keys can only be updated on generated user data")
+	}
+	userData, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	userData, err = setSSHKeys(userData, sshKeys)
+	if err != nil {
+		return nil, err
+	}
+	source["userDataBase64"] = base64.StdEncoding.EncodeToString(userData)
+	return nil, nil
+}
+
+// setSSHKeys authorises the first user of a cloud-config document with the
+// given public keys.
+func setSSHKeys(userData []byte, sshKeys []string) ([]byte, error) {
+	// Decoded loosely, as virtual machines created before the typed config
+	// may carry keys it does not know about.
+	config := map[string]interface{}{}
+	body := strings.TrimPrefix(string(userData), strings.TrimSpace(cloudConfigHeader))
+	if err := yaml.Unmarshal([]byte(body), &config); err != nil {
+		return nil, err
+	}
+	users, _ := config["users"].([]interface{})
+	if len(users) == 0 {
+		return nil, k8serrors.NewBadRequest("ssh keys cannot be updated, the cloud-init config has no users")
+	}
+	user, ok := users[0].(map[string]interface{})
+	if !ok {
+		return nil, k8serrors.NewBadRequest("ssh keys cannot be updated, the cloud-init config has a malformed user")
+	}
+	user["ssh_authorized_keys"] = sshKeys
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(cloudConfigHeader), data...), nil
+}
+
+// cloudInitVolume builds the cloud-init disk volume for a validated create
+// payload, combining the generated config with any raw user and network
+// data. Generated user data holds passwords and keys, so it is returned as
+// a Secret to create, which the volume references, rather than being
+// written into the virtual machine where anyone reading it would see it.
+func (vm *VirtualMachine) cloudInitVolume(payload clusters.ResourceDetails) (map[string]interface{}, *corev1.Secret, error) {
+	sourceKey := "cloudInitNoCloud"
+	if payload.CloudInit.Datasource == "configdrive" {
+		sourceKey = "cloudInitConfigDrive"
+	}
+	source := map[string]interface{}{}
+
+	userData := payload.UserData
+	if userData == nil {
+		userData = &clusters.CloudInitData{}
+	}
+	var secret *corev1.Secret
+	switch {
+	case userData.Mode == "replace" && userData.Secret != "":
+		if _, err := vm.managedSecret(userData.Secret); err != nil {
+			return nil, nil, err
+		}
+		source["userDataSecretRef"] = map[string]interface{}{"name": userData.Secret}
+	case userData.Mode == "replace":
+		source["userDataBase64"] = base64.StdEncoding.EncodeToString([]byte(userData.Inline))
+	default:
+		raw := userData.Inline
+		if userData.Secret != "" {
+			data, err := vm.secretData(userData.Secret, "userdata", "userData")
+			if err != nil {
+				return nil, nil, err
+			}
+			raw = string(data)
+		}
+		generated, err := newCloudConfig(payload).render()
+		if err != nil {
+			return nil, nil, err
+		}
+		merged, err := mergeUserData(generated, raw)
+		if err != nil {
+			return nil, nil, err
+		}
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				GenerateName: payload.Compute.Name + "-user-data-",
+				Namespace:    vm.project,
+				Labels:       map[string]string{userDataLabel: payload.Compute.Name},
+			},
+			Type: corev1.SecretTypeOpaque,
+			Data: map[string][]byte{userDataKey: merged},
+		}
+	}
+
+	if networkData := payload.NetworkData; networkData != nil {
+		if networkData.Secret != "" {
+			if _, err := vm.managedSecret(networkData.Secret); err != nil {
+				return nil, nil, err
+			}
+			source["networkDataSecretRef"] = map[string]interface{}{"name": networkData.Secret}
+		} else {
+			source["networkDataBase64"] = base64.StdEncoding.EncodeToString([]byte(networkData.Inline))
+		}
+	}
+
+	return map[string]interface{}{
+		"name":    "cloudinitdisk",
+		sourceKey: source,
+	}, secret, nil
+}
+
+// mergeUserData merges raw cloud-config user data into the generated config.
+// Lists from both are concatenated with the generated entries first, so the
+// created user and its keys are always present, while other values from the
+// raw data take precedence.
+func mergeUserData(generated []byte, raw string) ([]byte, error) {
+	if strings.TrimSpace(raw) == "" {
+		return generated, nil
+	}
+	if !strings.HasPrefix(raw, strings.TrimSpace(cloudConfigHeader)) {
+		return nil, k8serrors.NewBadRequest("only #cloud-config user_data can be merged, use mode replace for other formats")
+	}
+	base := map[string]interface{}{}
+	if err := yaml.Unmarshal(generated[len(cloudConfigHeader):], &base); err != nil {
+		return nil, err
+	}
+	extra := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(raw), &extra); err != nil {
+		return nil, k8serrors.NewBadRequest("user_data is not valid YAML: " + err.Error())
+	}
+	data, err := yaml.Marshal(mergeValues(base, extra))
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(cloudConfigHeader), data...), nil
+}
+
+func mergeValues(base, extra map[string]interface{}) map[string]interface{} {
+	for key, value := range extra {
+		switch existing := base[key].(type) {
+		case []interface{}:
+			if list, ok := value.([]interface{}); ok {
+				base[key] = append(existing, list...)
+				continue
+			}
+		case map[string]interface{}:
+			if nested, ok := value.(map[string]interface{}); ok {
+				base[key] = mergeValues(existing, nested)
+				continue
+			}
+		}
+		base[key] = value
+	}
+	return base
+}
+
+// secretData reads the first of the given keys found in a Secret of the
+// project namespace created through the API.
+func (vm *VirtualMachine) secretData(name string, keys ...string) ([]byte, error) {
+	secret, err := vm.managedSecret(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if data, found := secret.Data[key]; found {
+			return data, nil
+		}
+	}
+	return nil, k8serrors.NewBadRequest(fmt.Sprintf("secret %q has no %s key", name, strings.Join(keys, " or ")))
+}
+
+// managedSecret gets a Secret that virtual machines may reference, which
+// are those created through the API. Other Secrets of the namespace, such
+// as service account tokens, are reported as not found.
+func (vm *VirtualMachine) managedSecret(name string) (*corev1.Secret, error) {
+	ctx, cancel := clusters.WithTimeout(vm.ctx)
+	defer cancel()
+	secret, err := k8s.NewResource(vm.kubeconfig).Secret(ctx, vm.project, name)
+	if err == nil && !store.Managed(secret.Labels) {
+		err = k8serrors.NewNotFound(corev1.Resource("secrets"), name)
+	}
+	return secret, err
+}
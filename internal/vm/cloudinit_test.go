@@ -0,0 +1,141 @@
+package vm
+
+import (
+	"cloud/internal/clusters"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+)
+
+func TestCloudConfigRenderEscapesValues(t *testing.T) {
+	payload := clusters.ResourceDetails{
+		User: clusters.User{Name: "arthur", Password: "p:ss\" runcmd: [reboot]"},
+		Compute: clusters.Compute{
+			SSHKey: "ssh-ed25519 AAAAC3Nza arthur@laptop\nssh-rsa AAAAB3Nza ci",
+		},
+	}
+	data, err := newCloudConfig(payload).render()
+	if err != nil {
+		t.Fatalf("render failed: %v", err)
+	}
+	if !strings.HasPrefix(string(data), cloudConfigHeader) {
+		t.Errorf("expected cloud-config header, got %q", data)
+	}
+	var parsed cloudConfig
+	if err := yaml.UnmarshalStrict(data[len(cloudConfigHeader):], &parsed); err != nil {
+		t.Fatalf("rendered config does not parse: %v", err)
+	}
+	if len(parsed.RunCmd) != 0 {
+		t.Errorf("password injected runcmd entries: %v", parsed.RunCmd)
+	}
+	user := parsed.Users[0]
+	if user.PlainTextPasswd != payload.User.Password || user.LockPasswd || !parsed.SSHPwauth {
+		t.Errorf("unexpected password settings: %+v", user)
+	}
+	if len(user.SSHAuthorizedKeys) != 2 {
+		t.Errorf("expected 2 ssh keys, got %v", user.SSHAuthorizedKeys)
+	}
+}
+
+func TestCloudConfigWithKeysAndNoPassword(t *testing.T) {
+	payload := clusters.ResourceDetails{
+		User: clusters.User{Name: "arthur", SSHKeys: []string{"ssh-ed25519 CCCC user"}},
+		Compute: clusters.Compute{
+			SSHKey:  "ssh-ed25519 AAAA arthur@laptop",
+			SSHKeys: []string{"ssh-rsa BBBB ci"},
+		},
+	}
+	data, err := newCloudConfig(payload).render()
+	if err != nil {
+		t.Fatalf("render failed: %v", err)
+	}
+	var parsed cloudConfig
+	if err := yaml.UnmarshalStrict(data[len(cloudConfigHeader):], &parsed); err != nil {
+		t.Fatalf("rendered config does not parse: %v", err)
+	}
+	if parsed.SSHPwauth {
+		t.Error("expected password login to stay disabled without a password")
+	}
+	user := parsed.Users[0]
+	if !user.LockPasswd || user.PlainTextPasswd != "" {
+		t.Errorf("expected a locked password, got %+v", user)
+	}
+	expected := []string{"ssh-ed25519 AAAA arthur@laptop", "ssh-rsa BBBB ci", "ssh-ed25519 CCCC user"}
+	if strings.Join(user.SSHAuthorizedKeys, "|") != strings.Join(expected, "|") {
+		t.Errorf("expected keys %q, got %q", expected, user.SSHAuthorizedKeys)
+	}
+}
+
+func TestCloudConfigValidate(t *testing.T) {
+	payload := clusters.ResourceDetails{
+		User: clusters.User{Name: "root\nruncmd", Password: "secret"},
+		CloudInit: clusters.CloudInit{
+			Users:      []clusters.User{{Name: "ops"}},
+			WriteFiles: []clusters.WriteFile{{Path: "etc/motd"}},
+		},
+	}
+	_, err := newCloudConfig(payload).render()
+	if err == nil {
+		t.Fatal("expected validation to fail")
+	}
+	for _, field := range []string{"user.name", "cloud_init.users[0]", "cloud_init.write_files[0].path"} {
+		if !strings.Contains(err.Error(), field) {
+			t.Errorf("expected %s to be reported, got %v", field, err)
+		}
+	}
+}
+
+func TestMergeUserData(t *testing.T) {
+	generated, err := newCloudConfig(clusters.ResourceDetails{
+		User: clusters.User{Name: "arthur", Password: "secret"},
+	}).render()
+	if err != nil {
+		t.Fatalf("render failed: %v", err)
+	}
+	raw := "#cloud-config\nusers:\n  - name: backup\nssh_pwauth: false\nbootcmd:\n  - echo hi\n"
+	merged, err := mergeUserData(generated, raw)
+	if err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+	var parsed map[string]interface{}
+	if err := yaml.Unmarshal(merged[len(cloudConfigHeader):], &parsed); err != nil {
+		t.Fatalf("merged config does not parse: %v", err)
+	}
+	users := parsed["users"].([]interface{})
+	if len(users) != 2 || users[0].(map[string]interface{})["name"] != "arthur" {
+		t.Errorf("expected generated user first, got %v", users)
+	}
+	if parsed["ssh_pwauth"] != false || parsed["bootcmd"] == nil {
+		t.Errorf("expected raw values to be kept, got %v", parsed)
+	}
+
+	if _, err := mergeUserData(generated, "#!/bin/sh\necho hi\n"); err == nil {
+		t.Error("expected scripts to be rejected in merge mode")
+	}
+}
+
+func TestCloudInitVolumeKeepsUserDataOutOfTheSpec(t *testing.T) {
+	vm := &VirtualMachine{project: "p-1"}
+	payload := clusters.ResourceDetails{
+		User:    clusters.User{Name: "arthur", Password: "secret"},
+		Compute: clusters.Compute{Name: "web"},
+	}
+	volume, secret, err := vm.cloudInitVolume(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source := volume["cloudInitNoCloud"].(map[string]interface{}); len(source) != 0 {
+		t.Errorf("expected no user data in the volume, got %v", source)
+	}
+	if secret == nil || secret.Labels[userDataLabel] != "web" || !strings.Contains(string(secret.Data[userDataKey]), "secret") {
+		t.Fatalf("expected the user data in a secret, got %+v", secret)
+	}
+	data, err := setSSHKeys(secret.Data[userDataKey], []string{"ssh-ed25519 AAAAC3Nza arthur@laptop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "arthur@laptop") {
+		t.Errorf("expected the key to be set, got %s", data)
+	}
+}
@@ -0,0 +1,43 @@
+package vm
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// Event is the trimmed down representation of a watch event that is
+// streamed to clients.
+type Event struct {
+	Type            watch.EventType `json:"type"`
+	Name            string          `json:"name,omitempty"`
+	Phase           string          `json:"phase,omitempty"`
+	ResourceVersion string          `json:"resourceVersion,omitempty"`
+	Message         string          `json:"message,omitempty"`
+}
+
+// NewEvent trims a watch event on a VirtualMachine or VirtualMachineInstance
+// down to an Event.
+func NewEvent(event watch.Event) Event {
+	e := Event{Type: event.Type}
+	switch obj := event.Object.(type) {
+	case *unstructured.Unstructured:
+		e.Name = obj.GetName()
+		e.ResourceVersion = obj.GetResourceVersion()
+		e.Phase = phaseOf(obj)
+	case *metav1.Status:
+		e.Message = obj.Message
+	}
+	return e
+}
+
+// phaseOf returns the status of a VirtualMachine or the phase of a
+// VirtualMachineInstance.
+func phaseOf(obj *unstructured.Unstructured) string {
+	field := "printableStatus"
+	if obj.GetKind() == "VirtualMachineInstance" {
+		field = "phase"
+	}
+	phase, _, _ := unstructured.NestedString(obj.Object, "status", field)
+	return phase
+}
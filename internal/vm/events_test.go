@@ -0,0 +1,64 @@
+package vm
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func TestNewEvent(t *testing.T) {
+	vmi := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "kubevirt.io/v1",
+		"kind":       "VirtualMachineInstance",
+		"status":     map[string]interface{}{"phase": "Scheduling"},
+	}}
+	vmi.SetName("web")
+	vmi.SetResourceVersion("42")
+	vm := testVM("db", "Stopped", time.Now())
+	vm.SetResourceVersion("43")
+	status := k8serrors.NewResourceExpired("too old").Status()
+	bookmark := &unstructured.Unstructured{}
+	bookmark.SetResourceVersion("44")
+
+	tests := []struct {
+		name  string
+		event watch.Event
+		json  string
+	}{
+		{
+			name:  "virtual machine instance",
+			event: watch.Event{Type: watch.Modified, Object: vmi},
+			json:  `{"type":"MODIFIED","name":"web","phase":"Scheduling","resourceVersion":"42"}`,
+		},
+		{
+			name:  "virtual machine",
+			event: watch.Event{Type: watch.Added, Object: &vm},
+			json:  `{"type":"ADDED","name":"db","phase":"Stopped","resourceVersion":"43"}`,
+		},
+		{
+			name:  "bookmark",
+			event: watch.Event{Type: watch.Bookmark, Object: bookmark},
+			json:  `{"type":"BOOKMARK","resourceVersion":"44"}`,
+		},
+		{
+			name:  "error",
+			event: watch.Event{Type: watch.Error, Object: &status},
+			json:  `{"type":"ERROR","message":"too old"}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := json.Marshal(NewEvent(test.event))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != test.json {
+				t.Errorf("expected %s, got %s", test.json, data)
+			}
+		})
+	}
+}
@@ -2,19 +2,45 @@ package vm
 
 import (
 	"cloud/internal/clusters"
+	"cloud/internal/clusters/k8s"
 	"context"
-	"encoding/base64"
-	"errors"
+	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	"k8s.io/apimachinery/pkg/watch"
 	kvV1 "kubevirt.io/client-go/generated/kubevirt/clientset/versioned/typed/core/v1"
 )
 
+// GVKs are the kinds a virtual machine is made of, the VirtualMachine and
+// the VirtualMachineInstance running it.
+var GVKs = []schema.GroupVersionKind{
+	{
+		Group:   "kubevirt.io",
+		Version: "v1",
+		Kind:    "VirtualMachine",
+	},
+	{
+		Group:   "kubevirt.io",
+		Version: "v1",
+		Kind:    "VirtualMachineInstance",
+	},
+}
+
 type VirtualMachine struct {
 	ctx        context.Context
 	kubeconfig string
@@ -31,29 +57,30 @@ func NewCluster(req clusters.Resource) *VirtualMachine {
 	}
 }
 
-func (vm *VirtualMachine) Create() error {
-	// TODO: Prevent users from creating an insance with name watch,
-	// as creating such an instance will prevent thr router from listing
-	// the instance, instead serving the endpoint for watching websockets
+// Create validates the payload and creates the virtual machine it describes.
+// admit, when given, is called with the valid payload before anything is
+// created and aborts the creation by returning an error.
+func (vm *VirtualMachine) Create(admit func(clusters.ResourceDetails) error) error {
 	payload, err := clusters.Payload(vm.request)
 	if err != nil {
 		return err
 	}
-	name := payload.User.Name
-	passwd := payload.User.Password
-	cloudInitConfig := fmt.Sprintf(`#cloud-config
-users:
-  - name: %s
-    sudo: ALL=(ALL) NOPASSWD:ALL
-    groups: users
-    home: /home/%s
-    shell: /bin/bash
-    lock_passwd: false
-chpasswd:
-  list: |
-    %s:%s
-  expire: False`, name, name, name, passwd)
-	cloudInitBase64 := base64.StdEncoding.EncodeToString([]byte(cloudInitConfig))
+	errs := payload.Validate()
+	if !payload.ReplacesUserData() {
+		errs = append(errs, newCloudConfig(payload).validate()...)
+	}
+	if err := clusters.NewValidationError(errs); err != nil {
+		return err
+	}
+	if admit != nil {
+		if err := admit(payload); err != nil {
+			return err
+		}
+	}
+	cloudInitVolume, userData, err := vm.cloudInitVolume(payload)
+	if err != nil {
+		return err
+	}
 	obj := &unstructured.Unstructured{
 		Object: map[string]interface{}{
 			"apiVersion": "kubevirt.io/v1",
@@ -62,7 +89,7 @@ chpasswd:
 				"name": payload.Compute.Name,
 			},
 			"spec": map[string]interface{}{
-				"runStrategy": "RerunOnFailure",
+				"runStrategy": runStrategyOf(payload),
 				"template": map[string]interface{}{
 					"metadata": map[string]interface{}{
 						"labels": map[string]interface{}{
@@ -115,12 +142,7 @@ chpasswd:
 									"name": "os-volume-disk-" + payload.Compute.Name,
 								},
 							},
-							{
-								"name": "cloudinitdisk",
-								"cloudInitNoCloud": map[string]interface{}{
-									"userDataBase64": cloudInitBase64,
-								},
-							},
+							cloudInitVolume,
 						},
 					},
 				},
@@ -154,46 +176,473 @@ chpasswd:
 			},
 		},
 	}
-	_, err = clusters.CreateResourceSchema(obj, vm.kubeconfig, vm.project)
+	if userData == nil {
+		_, err = clusters.CreateResourceSchema(vm.ctx, obj, vm.kubeconfig, vm.project)
+		return err
+	}
+	return vm.createWithUserData(obj, cloudInitVolume, userData)
+}
+
+// runStrategyOf returns the run strategy a virtual machine is created with.
+// Virtual machines boot as soon as they are created by default.
+func runStrategyOf(payload clusters.ResourceDetails) string {
+	if payload.Compute.RunStrategy == "" {
+		return "RerunOnFailure"
+	}
+	return payload.Compute.RunStrategy
+}
+
+// createWithUserData creates a virtual machine along with the Secret its
+// generated user data is kept in. The Secret is created first so that the
+// virtual machine never boots without it, then owned by the virtual machine
+// so that it is deleted along with it.
+func (vm *VirtualMachine) createWithUserData(obj *unstructured.Unstructured, volume map[string]interface{}, userData *corev1.Secret) error {
+	ctx, cancel := clusters.WithTimeout(vm.ctx)
+	defer cancel()
+	secrets := k8s.NewResource(vm.kubeconfig)
+	userData, err := secrets.CreateSecret(ctx, userData)
 	if err != nil {
 		return err
 	}
+	for _, source := range volume {
+		if source, ok := source.(map[string]interface{}); ok {
+			source["userDataSecretRef"] = map[string]interface{}{"name": userData.Name}
+		}
+	}
+	created, err := clusters.CreateResourceSchema(ctx, obj, vm.kubeconfig, vm.project)
+	if err != nil {
+		if err := secrets.DeleteSecret(ctx, vm.project, userData.Name); err != nil {
+			slog.Error("Unable to delete the user data of a virtual machine that failed to be created", "secret", userData.Name, "error", err.Error())
+		}
+		return err
+	}
+	userData.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: created.GetAPIVersion(),
+		Kind:       created.GetKind(),
+		Name:       created.GetName(),
+		UID:        created.GetUID(),
+	}}
+	if _, err := secrets.UpdateSecret(ctx, userData); err != nil {
+		slog.Error("Unable to hand the user data over to its virtual machine", "secret", userData.Name, "name", created.GetName(), "error", err.Error())
+	}
 	return nil
 }
 
 func (vm *VirtualMachine) Delete() error {
 	vars := mux.Vars(vm.request)
 	name := vars["name"]
-	return clusters.DeleteResourceSchema(schema.GroupVersionKind{
+	return clusters.DeleteResourceSchema(vm.ctx, schema.GroupVersionKind{
 		Group:   "kubevirt.io",
 		Version: "v1",
 		Kind:    "VirtualMachine",
 	}, name, vm.kubeconfig, vm.project)
 }
 
-func (vm *VirtualMachine) Find() (map[string]interface{}, error) {
+// Find gets a virtual machine as an Instance, or as the raw VirtualMachine
+// or, with the "state=up" query, VirtualMachineInstance with "view=raw".
+func (vm *VirtualMachine) Find() (interface{}, error) {
+	vars := mux.Vars(vm.request)
+	name := vars["name"]
+	raw, err := vm.rawView()
+	if err != nil {
+		return nil, err
+	}
+	primary, counterpart := GVKs[0], GVKs[1]
+	if vm.request.URL.Query().Get("state") == "up" {
+		primary, counterpart = counterpart, primary
+	}
+	response, err := vm.get(primary, name)
+	if err != nil {
+		return nil, err
+	}
+	if raw {
+		return response.Object, nil
+	}
+	other, err := vm.get(counterpart, name)
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return nil, err
+	}
+	if primary == GVKs[0] {
+		return newInstance(response, other)
+	}
+	return newInstance(other, response)
+}
+
+// FindAll lists the virtual machines of the project, as Instances unless
+// "view=raw" is given. The "limit" and "continue" queries page through the
+// list, "selector" filters on labels, "phase" on a comma separated set of
+// phases, and "sort" orders the list by name or created, descending when
+// prefixed with "-". Phase and sort apply to the whole list, so they cannot
+// be combined with paging.
+func (vm *VirtualMachine) FindAll() ([]interface{}, *ListMeta, error) {
+	query := vm.request.URL.Query()
+	raw, err := vm.rawView()
+	if err != nil {
+		return nil, nil, err
+	}
+	primary, counterpart := GVKs[0], GVKs[1]
+	if query.Get("state") == "up" {
+		primary, counterpart = counterpart, primary
+	}
+	options, err := listOptions(query)
+	if err != nil {
+		return nil, nil, err
+	}
+	response, err := vm.list(primary, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	items := filterPhase(response.Items, query.Get("phase"))
+	if err := sortItems(items, query.Get("sort")); err != nil {
+		return nil, nil, err
+	}
+	meta := &ListMeta{
+		Count:           len(items),
+		Limit:           options.Limit,
+		Continue:        response.GetContinue(),
+		Remaining:       response.GetRemainingItemCount(),
+		ResourceVersion: response.GetResourceVersion(),
+	}
+	result := make([]interface{}, len(items))
+	if raw {
+		for i, item := range items {
+			result[i] = item.Object
+		}
+		return result, meta, nil
+	}
+
+	byName, err := vm.counterparts(counterpart, items, options.Limit > 0 || options.Continue != "")
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range items {
+		var instance *Instance
+		if primary == GVKs[0] {
+			instance, err = newInstance(&items[i], byName[items[i].GetName()])
+		} else {
+			instance, err = newInstance(byName[items[i].GetName()], &items[i])
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		result[i] = instance
+	}
+	return result, meta, nil
+}
+
+// counterpartFetches bounds how many objects a page of a list gets at once.
+const counterpartFetches = 8
+
+// counterparts gets the objects of gvk named like items, by name. A page of
+// a longer list gets them by name, a few at a time, so that its cost does
+// not grow with the whole list, while a complete list lists them all at
+// once.
+func (vm *VirtualMachine) counterparts(gvk schema.GroupVersionKind, items []unstructured.Unstructured, paged bool) (map[string]*unstructured.Unstructured, error) {
+	byName := map[string]*unstructured.Unstructured{}
+	if !paged {
+		others, err := vm.list(gvk, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for i := range others.Items {
+			byName[others.Items[i].GetName()] = &others.Items[i]
+		}
+		return byName, nil
+	}
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+	)
+	slots := make(chan struct{}, counterpartFetches)
+	for i := range items {
+		name := items[i].GetName()
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-slots; wg.Done() }()
+			other, err := vm.get(gvk, name)
+			if k8serrors.IsNotFound(err) {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			byName[name] = other
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return byName, nil
+}
+
+// get reads a resource of the project from the cache, unless the
+// "consistent=true" query asks for a live read.
+func (vm *VirtualMachine) get(gvk schema.GroupVersionKind, name string) (*unstructured.Unstructured, error) {
+	if vm.request.URL.Query().Get("consistent") != "true" {
+		response, cached, err := clusters.CachedGetResourceSchema(gvk, name, vm.kubeconfig, vm.project)
+		if cached {
+			return response, err
+		}
+	}
+	return clusters.GetResourceSchema(vm.ctx, gvk, name, vm.kubeconfig, vm.project)
+}
+
+// list lists resources of the project from the cache, unless the
+// "consistent=true" query asks for a live read or the options page through
+// the list, which the cache cannot honour.
+func (vm *VirtualMachine) list(gvk schema.GroupVersionKind, options metav1.ListOptions) (*unstructured.UnstructuredList, error) {
+	if vm.request.URL.Query().Get("consistent") != "true" && options.Limit == 0 && options.Continue == "" {
+		selector, err := labels.Parse(options.LabelSelector)
+		if err != nil {
+			return nil, err
+		}
+		response, cached, err := clusters.CachedListResourceSchema(gvk, vm.kubeconfig, vm.project, selector)
+		if cached {
+			return response, err
+		}
+	}
+	return clusters.ListResourceSchema(vm.ctx, gvk, vm.kubeconfig, vm.project, options)
+}
+
+// PatchNotes lists the payload fields of a patch that did not take effect
+// right away.
+type PatchNotes struct {
+	// RestartRequired fields take effect once the virtual machine has been
+	// restarted.
+	RestartRequired []string `json:"restart_required,omitempty"`
+	// ProvisionOnly fields are stored in the cloud-init user data, which
+	// cloud-init only applies when a guest is first provisioned. They do
+	// not reach a guest that has already booted, even after a restart.
+	ProvisionOnly []string `json:"provision_only,omitempty"`
+}
+
+// Patch applies the vCPUs, memory, storage and SSH keys of the request
+// payload to an existing virtual machine using a JSON merge patch. It returns the updated
+// virtual machine along with the payload fields that did not take effect
+// right away.
+func (vm *VirtualMachine) Patch() (interface{}, *PatchNotes, error) {
 	vars := mux.Vars(vm.request)
 	name := vars["name"]
+	raw, err := vm.rawView()
+	if err != nil {
+		return nil, nil, err
+	}
+	payload, err := clusters.Payload(vm.request)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := clusters.NewValidationError(payload.ValidateUpdate()); err != nil {
+		return nil, nil, err
+	}
 	gvk := schema.GroupVersionKind{
 		Group:   "kubevirt.io",
 		Version: "v1",
 		Kind:    "VirtualMachine",
 	}
-	if vm.request.URL.Query().Get("state") == "up" {
-		gvk = schema.GroupVersionKind{
-			Group:   "kubevirt.io",
+	current, err := clusters.GetResourceSchema(vm.ctx, gvk, name, vm.kubeconfig, vm.project)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	notes := &PatchNotes{}
+	var userData *corev1.Secret
+	domain := map[string]interface{}{}
+	templateSpec := map[string]interface{}{}
+	spec := map[string]interface{}{}
+	if payload.Compute.CPU > 0 {
+		domain["cpu"] = map[string]interface{}{
+			"cores": payload.Compute.CPU,
+		}
+		notes.RestartRequired = append(notes.RestartRequired, "vcpu")
+	}
+	if payload.Compute.RAM != "" {
+		domain["resources"] = map[string]interface{}{
+			"limits": map[string]interface{}{
+				"memory": payload.Compute.RAM,
+			},
+		}
+		notes.RestartRequired = append(notes.RestartRequired, "ram")
+	}
+	if sshKeys := payload.Compute.AuthorizedKeys(); len(sshKeys) > 0 {
+		// Merge patches replace lists wholesale, so the volumes are patched
+		// from the current object with the cloud-init disk rewritten.
+		volumes, _, err := unstructured.NestedSlice(current.Object, "spec", "template", "spec", "volumes")
+		if err != nil {
+			return nil, nil, err
+		}
+		userData, err = vm.setCloudInitSSHKeys(name, volumes, sshKeys)
+		if err != nil {
+			return nil, nil, err
+		}
+		if userData == nil {
+			templateSpec["volumes"] = volumes
+		}
+		// cloud-init sets up users once per instance id, which KubeVirt
+		// derives from the virtual machine, so the keys only apply to a
+		// guest provisioned afresh, such as one restored into a new VM.
+		notes.ProvisionOnly = append(notes.ProvisionOnly, "ssh_key")
+	}
+	if payload.Compute.Storage != "" {
+		templates, _, err := unstructured.NestedSlice(current.Object, "spec", "dataVolumeTemplates")
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, template := range templates {
+			t, ok := template.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if dvName, _, _ := unstructured.NestedString(t, "metadata", "name"); dvName != "os-volume-disk-"+name {
+				continue
+			}
+			if err := vm.checkDiskGrowth(name, t, payload.Compute.Storage); err != nil {
+				return nil, nil, err
+			}
+			err := unstructured.SetNestedField(t, payload.Compute.Storage, "spec", "storage", "resources", "requests", "storage")
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		spec["dataVolumeTemplates"] = templates
+	}
+	if len(domain) > 0 {
+		templateSpec["domain"] = domain
+	}
+	if len(templateSpec) > 0 {
+		spec["template"] = map[string]interface{}{
+			"spec": templateSpec,
+		}
+	}
+	if len(spec) == 0 && userData == nil {
+		return nil, nil, k8serrors.NewBadRequest("nothing to update, expected vcpu, ram, storage or ssh keys")
+	}
+
+	response := current
+	if len(spec) > 0 {
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				// Guards the copied lists against concurrent updates.
+				"resourceVersion": current.GetResourceVersion(),
+			},
+			"spec": spec,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		response, err = clusters.PatchResourceSchema(vm.ctx, name, vm.kubeconfig, vm.project, gvk, patch, types.MergePatchType)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if userData != nil {
+		ctx, cancel := clusters.WithTimeout(vm.ctx)
+		defer cancel()
+		if _, err := k8s.NewResource(vm.kubeconfig).UpdateSecret(ctx, userData); err != nil {
+			return nil, nil, err
+		}
+	}
+	if payload.Compute.Storage != "" {
+		// Growing the template alone does not touch a provisioned disk, the
+		// claim backing it has to be expanded as well. This is done last as
+		// a disk cannot be shrunk back should the virtual machine patch
+		// fail, while a failure here is retried with the same request.
+		claimPatch, err := json.Marshal(map[string]interface{}{
+			"spec": map[string]interface{}{
+				"resources": map[string]interface{}{
+					"requests": map[string]interface{}{
+						"storage": payload.Compute.Storage,
+					},
+				},
+			},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		_, err = clusters.PatchResourceSchema(vm.ctx, "os-volume-disk-"+name, vm.kubeconfig, vm.project, schema.GroupVersionKind{
+			Group:   "",
 			Version: "v1",
-			Kind:    "VirtualMachineInstance",
+			Kind:    "PersistentVolumeClaim",
+		}, claimPatch, types.MergePatchType)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if raw {
+		return response.Object, notes, nil
+	}
+	running, err := vm.get(GVKs[1], name)
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return nil, nil, err
+	}
+	instance, err := newInstance(response, running)
+	if err != nil {
+		return nil, nil, err
+	}
+	return instance, notes, nil
+}
+
+// checkDiskGrowth rejects a disk size that is smaller than the current one,
+// or larger on a storage class that cannot expand claims. It runs before
+// anything is changed, as a disk template patched to a size its claim never
+// reaches leaves the two out of step for good.
+func (vm *VirtualMachine) checkDiskGrowth(name string, template map[string]interface{}, storage string) error {
+	path := field.NewPath("compute", "storage")
+	requested, err := resource.ParseQuantity(storage)
+	if err != nil {
+		return clusters.NewValidationError(field.ErrorList{field.Invalid(path, storage, err.Error())})
+	}
+	current := resource.Quantity{}
+	if size, _, _ := unstructured.NestedString(template, "spec", "storage", "resources", "requests", "storage"); size != "" {
+		if quantity, err := resource.ParseQuantity(size); err == nil {
+			current = quantity
 		}
 	}
-	response, err := clusters.GetResourceSchema(gvk, name, vm.kubeconfig, vm.project)
+	clientSet, err := k8s.ClientSet(vm.kubeconfig)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	ctx, cancel := clusters.WithTimeout(vm.ctx)
+	defer cancel()
+	claim, err := clientSet.CoreV1().PersistentVolumeClaims(vm.project).Get(ctx, "os-volume-disk-"+name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		claim, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+	if claim != nil {
+		if size, ok := claim.Spec.Resources.Requests[corev1.ResourceStorage]; ok && size.Cmp(current) > 0 {
+			current = size
+		}
+	}
+	switch requested.Cmp(current) {
+	case -1:
+		return clusters.NewValidationError(field.ErrorList{field.Invalid(path, storage, "must not be smaller than the current size of "+current.String())})
+	case 0:
+		return nil
+	}
+	if claim == nil || claim.Spec.StorageClassName == nil {
+		return nil
+	}
+	class, err := clientSet.StorageV1().StorageClasses().Get(ctx, *claim.Spec.StorageClassName, metav1.GetOptions{})
+	if err != nil {
+		return err
 	}
-	return response.Object, nil
+	if class.AllowVolumeExpansion == nil || !*class.AllowVolumeExpansion {
+		return clusters.NewValidationError(field.ErrorList{field.Invalid(path, storage, fmt.Sprintf("the storage class %q does not allow growing disks", class.Name))})
+	}
+	return nil
 }
 
-func (vm *VirtualMachine) FindAll() ([]map[string]interface{}, error) {
+func (vm *VirtualMachine) Watch() (watch.Interface, error) {
 	gvk := schema.GroupVersionKind{
 		Group:   "kubevirt.io",
 		Version: "v1",
@@ -206,31 +655,42 @@ func (vm *VirtualMachine) FindAll() ([]map[string]interface{}, error) {
 			Kind:    "VirtualMachineInstance",
 		}
 	}
-	response, err := clusters.ListResourceSchema(gvk, vm.kubeconfig, vm.project)
+	resourceVersion := vm.request.URL.Query().Get("resourceVersion")
+	return clusters.ResumeWatchResourceSchema(vm.ctx, gvk, vm.kubeconfig, vm.project, resourceVersion)
+}
+
+func (vm *VirtualMachine) VNC() (kvV1.StreamInterface, error) {
+	vars := mux.Vars(vm.request)
+	name := vars["name"]
+	kubevirt, err := clusters.KubevirtResourceSchema(vm.kubeconfig)
 	if err != nil {
 		return nil, err
 	}
-	result := make([]map[string]interface{}, len(response.Items))
-	for i, item := range response.Items {
-		result[i] = item.Object
-	}
-	return result, nil
-}
-
-func (vm *VirtualMachine) Patch() (map[string]interface{}, error) {
-	return nil, errors.New("not implemented yet")
-}
-
-func (vm *VirtualMachine) Watch() (watch.Interface, error) {
-	return nil, errors.New("not implemented yet")
+	return kubevirt.VirtualMachineInstance(vm.project).VNC(name)
 }
 
-func (vm *VirtualMachine) VNC() (kvV1.StreamInterface, error) {
+// Console opens the serial console of the virtual machine instance. The
+// "timeout" query, in seconds, overrides defaultTimeout for how long to wait
+// for the console to become available.
+func (vm *VirtualMachine) Console(defaultTimeout time.Duration) (kvV1.StreamInterface, error) {
 	vars := mux.Vars(vm.request)
 	name := vars["name"]
+	timeout := defaultTimeout
+	if value := vm.request.URL.Query().Get("timeout"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			return nil, k8serrors.NewBadRequest("timeout must be a positive number of seconds")
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
 	kubevirt, err := clusters.KubevirtResourceSchema(vm.kubeconfig)
 	if err != nil {
 		return nil, err
 	}
-	return kubevirt.VirtualMachineInstance(vm.project).VNC(name)
+	return kubevirt.VirtualMachineInstance(vm.project).SerialConsole(name, &kvV1.SerialConsoleOptions{
+		ConnectionTimeout: timeout,
+	})
 }
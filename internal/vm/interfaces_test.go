@@ -0,0 +1,208 @@
+package vm
+
+import (
+	"cloud/internal/clusters"
+	"cloud/internal/clusters/k8s"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestRunStrategyOf(t *testing.T) {
+	tests := []struct {
+		requested string
+		expected  string
+	}{
+		{"", "RerunOnFailure"},
+		{"Halted", "Halted"},
+		{"Manual", "Manual"},
+		{"Always", "Always"},
+	}
+	for _, test := range tests {
+		payload := clusters.ResourceDetails{Compute: clusters.Compute{RunStrategy: test.requested}}
+		if got := runStrategyOf(payload); got != test.expected {
+			t.Errorf("runStrategyOf(%q) = %q; want %q", test.requested, got, test.expected)
+		}
+	}
+}
+
+// testMapper maps the kinds read in tests.
+type testMapper struct {
+	*meta.DefaultRESTMapper
+}
+
+func (testMapper) Reset() {}
+
+// fakeReads serves the virtual machines of a fake cluster, counting the
+// reads that reach it rather than a cache.
+type fakeReads struct {
+	mu    sync.Mutex
+	reads map[string]int
+}
+
+func (f *fakeReads) count(verb string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.reads[verb]
+}
+
+func newFakeReads(t *testing.T, objects ...runtime.Object) *fakeReads {
+	t.Helper()
+	reads := &fakeReads{reads: map[string]int{}}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "kubevirt.io", Version: "v1", Resource: "virtualmachines"}: "VirtualMachineList",
+	}, objects...)
+	client.PrependReactor("*", "virtualmachines", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		reads.mu.Lock()
+		defer reads.mu.Unlock()
+		reads.reads[action.GetVerb()]++
+		return false, nil, nil
+	})
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(GVKs[0], meta.RESTScopeNamespace)
+	clientsFor := k8s.ClientsFor
+	k8s.ClientsFor = func(string) (*k8s.Clients, error) {
+		return k8s.NewClients(client, testMapper{mapper}), nil
+	}
+	t.Cleanup(func() { k8s.ClientsFor = clientsFor })
+	return reads
+}
+
+func TestReadsPreferTheCache(t *testing.T) {
+	web := testVM("web", "Running", time.Now())
+	web.SetNamespace("p-1")
+	reads := newFakeReads(t, &web)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	newVM := func(query string) *VirtualMachine {
+		return &VirtualMachine{
+			ctx:        ctx,
+			kubeconfig: "cache-test",
+			project:    "p-1",
+			request:    httptest.NewRequest(http.MethodGet, "/1.0/virtual-machines?"+query, nil),
+		}
+	}
+
+	// Without a cache every read goes to the cluster.
+	if _, err := newVM("").get(GVKs[0], "web"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newVM("").list(GVKs[0], metav1.ListOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if reads.count("get") != 1 || reads.count("list") != 1 {
+		t.Fatalf("expected reads to fall back to the cluster, got %d gets and %d lists", reads.count("get"), reads.count("list"))
+	}
+
+	if err := clusters.StartCache(ctx, "cache-test", GVKs[0]); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !clusters.CacheStatus()[GVKs[0].GroupKind().String()] {
+		if time.Now().After(deadline) {
+			t.Fatal("the cache did not sync")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	gets, lists := reads.count("get"), reads.count("list")
+
+	tests := []struct {
+		name    string
+		query   string
+		read    func(vm *VirtualMachine) (int, error)
+		items   int
+		live    string
+		missing bool
+	}{
+		{
+			name: "get from the cache",
+			read: func(vm *VirtualMachine) (int, error) {
+				_, err := vm.get(GVKs[0], "web")
+				return 1, err
+			},
+			items: 1,
+		},
+		{
+			name: "missing from the cache",
+			read: func(vm *VirtualMachine) (int, error) {
+				_, err := vm.get(GVKs[0], "db")
+				return 0, err
+			},
+			missing: true,
+		},
+		{
+			name:  "consistent get",
+			query: "consistent=true",
+			read: func(vm *VirtualMachine) (int, error) {
+				_, err := vm.get(GVKs[0], "web")
+				return 1, err
+			},
+			items: 1,
+			live:  "get",
+		},
+		{
+			name: "list from the cache",
+			read: func(vm *VirtualMachine) (int, error) {
+				list, err := vm.list(GVKs[0], metav1.ListOptions{})
+				if err != nil {
+					return 0, err
+				}
+				return len(list.Items), nil
+			},
+			items: 1,
+		},
+		{
+			name: "paged list",
+			read: func(vm *VirtualMachine) (int, error) {
+				list, err := vm.list(GVKs[0], metav1.ListOptions{Limit: 10})
+				if err != nil {
+					return 0, err
+				}
+				return len(list.Items), nil
+			},
+			items: 1,
+			live:  "list",
+		},
+		{
+			name:  "consistent list",
+			query: "consistent=true",
+			read: func(vm *VirtualMachine) (int, error) {
+				list, err := vm.list(GVKs[0], metav1.ListOptions{})
+				if err != nil {
+					return 0, err
+				}
+				return len(list.Items), nil
+			},
+			items: 1,
+			live:  "list",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			items, err := test.read(newVM(test.query))
+			if test.missing {
+				if !k8serrors.IsNotFound(err) {
+					t.Errorf("expected not found, got %v", err)
+				}
+			} else if err != nil || items != test.items {
+				t.Errorf("expected %d items, got %d %v", test.items, items, err)
+			}
+			liveGets, liveLists := reads.count("get")-gets, reads.count("list")-lists
+			gets, lists = reads.count("get"), reads.count("list")
+			if (liveGets > 0) != (test.live == "get") || (liveLists > 0) != (test.live == "list") {
+				t.Errorf("expected live reads %q, got %d gets and %d lists", test.live, liveGets, liveLists)
+			}
+		})
+	}
+}
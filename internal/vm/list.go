@@ -0,0 +1,105 @@
+package vm
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// maxListLimit caps the page size a client may ask for.
+const maxListLimit = 500
+
+// ListMeta describes a page of virtual machines. Continue is set when more
+// items are available and is passed back as the "continue" query to fetch
+// the next page.
+type ListMeta struct {
+	Count           int    `json:"count"`
+	Limit           int64  `json:"limit,omitempty"`
+	Continue        string `json:"continue,omitempty"`
+	Remaining       *int64 `json:"remaining,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+// listOptions builds the list options for the paging and label selector
+// queries of a list request. Filtering on phase and sorting are done by the
+// server on the items it gets, so they are rejected along with paging, which
+// would only filter or sort a single page of the list.
+func listOptions(query url.Values) (metav1.ListOptions, error) {
+	options := metav1.ListOptions{
+		Continue:      query.Get("continue"),
+		LabelSelector: query.Get("selector"),
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || limit <= 0 || limit > maxListLimit {
+			return options, k8serrors.NewBadRequest(fmt.Sprintf("limit must be between 1 and %d", maxListLimit))
+		}
+		options.Limit = limit
+	}
+	if (options.Limit > 0 || options.Continue != "") && (query.Get("phase") != "" || query.Get("sort") != "") {
+		return options, k8serrors.NewBadRequest("phase and sort cannot be combined with limit or continue")
+	}
+	if _, err := labels.Parse(options.LabelSelector); err != nil {
+		return options, k8serrors.NewBadRequest("invalid selector: " + err.Error())
+	}
+	return options, nil
+}
+
+// filterPhase keeps the items whose phase is in the comma separated list of
+// phases, compared case insensitively. All items are kept when it is empty.
+func filterPhase(items []unstructured.Unstructured, phases string) []unstructured.Unstructured {
+	if phases == "" {
+		return items
+	}
+	wanted := map[string]bool{}
+	for _, phase := range strings.Split(phases, ",") {
+		wanted[strings.ToLower(strings.TrimSpace(phase))] = true
+	}
+	filtered := []unstructured.Unstructured{}
+	for _, item := range items {
+		if wanted[strings.ToLower(phaseOf(&item))] {
+			filtered = append(filtered, item)
+		}
+	}
+	return filtered
+}
+
+// sortItems orders items by name or created, descending when the key is
+// prefixed with "-".
+func sortItems(items []unstructured.Unstructured, key string) error {
+	descending := strings.HasPrefix(key, "-")
+	key = strings.TrimPrefix(key, "-")
+	var less func(a, b *unstructured.Unstructured) bool
+	switch key {
+	case "":
+		return nil
+	case "name":
+		less = func(a, b *unstructured.Unstructured) bool {
+			return a.GetName() < b.GetName()
+		}
+	case "created":
+		less = func(a, b *unstructured.Unstructured) bool {
+			at, bt := a.GetCreationTimestamp(), b.GetCreationTimestamp()
+			if at.Equal(&bt) {
+				return a.GetName() < b.GetName()
+			}
+			return at.Before(&bt)
+		}
+	default:
+		return k8serrors.NewBadRequest(fmt.Sprintf("unsupported sort %q, expected name or created", key))
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		if descending {
+			return less(&items[j], &items[i])
+		}
+		return less(&items[i], &items[j])
+	})
+	return nil
+}
@@ -0,0 +1,72 @@
+package vm
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func testVM(name, status string, created time.Time) unstructured.Unstructured {
+	item := unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "kubevirt.io/v1",
+		"kind":       "VirtualMachine",
+		"status": map[string]interface{}{
+			"printableStatus": status,
+		},
+	}}
+	item.SetName(name)
+	item.SetCreationTimestamp(metav1.NewTime(created))
+	return item
+}
+
+func TestFilterAndSortItems(t *testing.T) {
+	now := time.Now()
+	items := []unstructured.Unstructured{
+		testVM("web", "Running", now),
+		testVM("db", "Stopped", now.Add(-time.Hour)),
+		testVM("cache", "Running", now.Add(-2*time.Hour)),
+	}
+	running := filterPhase(items, "running, paused")
+	if len(running) != 2 {
+		t.Fatalf("expected 2 running items, got %d", len(running))
+	}
+	if err := sortItems(running, "-created"); err != nil {
+		t.Fatal(err)
+	}
+	if running[0].GetName() != "web" || running[1].GetName() != "cache" {
+		t.Errorf("unexpected order %s, %s", running[0].GetName(), running[1].GetName())
+	}
+	if err := sortItems(items, "name"); err != nil {
+		t.Fatal(err)
+	}
+	if items[0].GetName() != "cache" || items[2].GetName() != "web" {
+		t.Errorf("unexpected order %s, %s, %s", items[0].GetName(), items[1].GetName(), items[2].GetName())
+	}
+	if err := sortItems(items, "size"); err == nil {
+		t.Error("expected an unsupported sort to fail")
+	}
+}
+
+func TestListOptions(t *testing.T) {
+	options, err := listOptions(url.Values{"limit": {"50"}, "continue": {"token"}, "selector": {"tier=web"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.Limit != 50 || options.Continue != "token" || options.LabelSelector != "tier=web" {
+		t.Errorf("unexpected options %+v", options)
+	}
+	for _, query := range []url.Values{
+		{"limit": {"0"}},
+		{"limit": {"many"}},
+		{"selector": {"tier in"}},
+		{"limit": {"50"}, "phase": {"Running"}},
+		{"continue": {"token"}, "sort": {"-created"}},
+	} {
+		if _, err := listOptions(query); err == nil {
+			t.Errorf("expected %v to be rejected", query)
+		}
+	}
+}
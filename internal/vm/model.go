@@ -0,0 +1,192 @@
+package vm
+
+import (
+	"fmt"
+	"time"
+
+	k8sv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+// InstanceVersion is the version of the Instance representation. It only
+// changes when a field is removed or changes meaning.
+const InstanceVersion = "v1"
+
+// Instance is the stable representation of a virtual machine, merged from
+// its VirtualMachine and, while it runs, its VirtualMachineInstance.
+type Instance struct {
+	Version    string      `json:"version"`
+	Name       string      `json:"name"`
+	Project    string      `json:"project"`
+	State      string      `json:"state"`
+	VCPU       uint32      `json:"vcpu"`
+	RAM        string      `json:"ram,omitempty"`
+	Disks      []Disk      `json:"disks"`
+	IPs        []string    `json:"ips"`
+	Node       string      `json:"node,omitempty"`
+	Created    time.Time   `json:"created"`
+	Conditions []Condition `json:"conditions"`
+}
+
+type Disk struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Bus    string `json:"bus,omitempty"`
+	Source string `json:"source,omitempty"`
+	Size   string `json:"size,omitempty"`
+}
+
+type Condition struct {
+	Type    string    `json:"type"`
+	Status  string    `json:"status"`
+	Reason  string    `json:"reason,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Changed time.Time `json:"changed,omitempty"`
+}
+
+// rawView reports whether the request asks for the unconverted objects
+// through the "view=raw" query.
+func (vm *VirtualMachine) rawView() (bool, error) {
+	switch view := vm.request.URL.Query().Get("view"); view {
+	case "":
+		return false, nil
+	case "raw":
+		return true, nil
+	default:
+		return false, k8serrors.NewBadRequest(fmt.Sprintf("unsupported view %q, expected raw", view))
+	}
+}
+
+// newInstance merges a VirtualMachine and its VirtualMachineInstance, either
+// of which may be nil, into an Instance. The instance is preferred for
+// values that reflect what is actually running.
+func newInstance(vmObj, vmiObj *unstructured.Unstructured) (*Instance, error) {
+	var machine *kubevirtv1.VirtualMachine
+	var running *kubevirtv1.VirtualMachineInstance
+	if vmObj != nil {
+		machine = &kubevirtv1.VirtualMachine{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(vmObj.Object, machine); err != nil {
+			return nil, err
+		}
+	}
+	if vmiObj != nil {
+		running = &kubevirtv1.VirtualMachineInstance{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(vmiObj.Object, running); err != nil {
+			return nil, err
+		}
+	}
+
+	instance := &Instance{
+		Version:    InstanceVersion,
+		Disks:      []Disk{},
+		IPs:        []string{},
+		Conditions: []Condition{},
+	}
+	var spec *kubevirtv1.VirtualMachineInstanceSpec
+	dataVolumeSizes := map[string]string{}
+	if machine != nil {
+		instance.Name = machine.Name
+		instance.Project = machine.Namespace
+		instance.State = string(machine.Status.PrintableStatus)
+		instance.Created = machine.CreationTimestamp.Time
+		if machine.Spec.Template != nil {
+			spec = &machine.Spec.Template.Spec
+		}
+		for _, template := range machine.Spec.DataVolumeTemplates {
+			if template.Spec.Storage != nil {
+				if size, ok := template.Spec.Storage.Resources.Requests[k8sv1.ResourceStorage]; ok {
+					dataVolumeSizes[template.Name] = size.String()
+				}
+			} else if template.Spec.PVC != nil {
+				if size, ok := template.Spec.PVC.Resources.Requests[k8sv1.ResourceStorage]; ok {
+					dataVolumeSizes[template.Name] = size.String()
+				}
+			}
+		}
+		for _, condition := range machine.Status.Conditions {
+			instance.Conditions = append(instance.Conditions, Condition{
+				Type:    string(condition.Type),
+				Status:  string(condition.Status),
+				Reason:  condition.Reason,
+				Message: condition.Message,
+				Changed: condition.LastTransitionTime.Time,
+			})
+		}
+	}
+	if running != nil {
+		if machine == nil {
+			instance.Name = running.Name
+			instance.Project = running.Namespace
+			instance.State = string(running.Status.Phase)
+			instance.Created = running.CreationTimestamp.Time
+			for _, condition := range running.Status.Conditions {
+				instance.Conditions = append(instance.Conditions, Condition{
+					Type:    string(condition.Type),
+					Status:  string(condition.Status),
+					Reason:  condition.Reason,
+					Message: condition.Message,
+					Changed: condition.LastTransitionTime.Time,
+				})
+			}
+		}
+		spec = &running.Spec
+		instance.Node = running.Status.NodeName
+		for _, iface := range running.Status.Interfaces {
+			if len(iface.IPs) > 0 {
+				instance.IPs = append(instance.IPs, iface.IPs...)
+			} else if iface.IP != "" {
+				instance.IPs = append(instance.IPs, iface.IP)
+			}
+		}
+	}
+	if spec == nil {
+		return instance, nil
+	}
+
+	domain := spec.Domain
+	instance.VCPU = 1
+	if domain.CPU != nil {
+		instance.VCPU = max(domain.CPU.Cores, 1) * max(domain.CPU.Sockets, 1) * max(domain.CPU.Threads, 1)
+	}
+	if memory, ok := domain.Resources.Limits[k8sv1.ResourceMemory]; ok {
+		instance.RAM = memory.String()
+	} else if memory, ok := domain.Resources.Requests[k8sv1.ResourceMemory]; ok {
+		instance.RAM = memory.String()
+	} else if domain.Memory != nil && domain.Memory.Guest != nil {
+		instance.RAM = domain.Memory.Guest.String()
+	}
+	volumes := map[string]kubevirtv1.Volume{}
+	for _, volume := range spec.Volumes {
+		volumes[volume.Name] = volume
+	}
+	for _, d := range domain.Devices.Disks {
+		disk := Disk{Name: d.Name, Type: "disk"}
+		switch {
+		case d.Disk != nil:
+			disk.Bus = string(d.Disk.Bus)
+		case d.CDRom != nil:
+			disk.Type = "cdrom"
+			disk.Bus = string(d.CDRom.Bus)
+		case d.LUN != nil:
+			disk.Type = "lun"
+			disk.Bus = string(d.LUN.Bus)
+		}
+		volume := volumes[d.Name]
+		switch {
+		case volume.DataVolume != nil:
+			disk.Source = "dataVolume/" + volume.DataVolume.Name
+			disk.Size = dataVolumeSizes[volume.DataVolume.Name]
+		case volume.PersistentVolumeClaim != nil:
+			disk.Source = "persistentVolumeClaim/" + volume.PersistentVolumeClaim.ClaimName
+		case volume.ContainerDisk != nil:
+			disk.Source = "containerDisk/" + volume.ContainerDisk.Image
+		case volume.CloudInitNoCloud != nil, volume.CloudInitConfigDrive != nil:
+			disk.Source = "cloudInit"
+		}
+		instance.Disks = append(instance.Disks, disk)
+	}
+	return instance, nil
+}
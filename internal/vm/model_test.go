@@ -0,0 +1,96 @@
+package vm
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestNewInstanceMergesVMAndVMI(t *testing.T) {
+	machine := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "kubevirt.io/v1",
+		"kind":       "VirtualMachine",
+		"metadata": map[string]interface{}{
+			"name":              "web",
+			"namespace":         "swift-abc",
+			"creationTimestamp": "2024-05-01T10:00:00Z",
+			"managedFields":     []interface{}{map[string]interface{}{"manager": "anvil"}},
+		},
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"domain": map[string]interface{}{
+						"cpu": map[string]interface{}{"cores": int64(2)},
+						"devices": map[string]interface{}{
+							"disks": []interface{}{
+								map[string]interface{}{"name": "os-disk-web", "disk": map[string]interface{}{"bus": "virtio"}},
+								map[string]interface{}{"name": "cloudinitdisk", "cdrom": map[string]interface{}{"bus": "sata"}},
+							},
+						},
+						"resources": map[string]interface{}{
+							"limits": map[string]interface{}{"memory": "2Gi"},
+						},
+					},
+					"volumes": []interface{}{
+						map[string]interface{}{"name": "os-disk-web", "dataVolume": map[string]interface{}{"name": "os-volume-disk-web"}},
+						map[string]interface{}{"name": "cloudinitdisk", "cloudInitNoCloud": map[string]interface{}{"userDataBase64": ""}},
+					},
+				},
+			},
+			"dataVolumeTemplates": []interface{}{
+				map[string]interface{}{
+					"metadata": map[string]interface{}{"name": "os-volume-disk-web"},
+					"spec": map[string]interface{}{
+						"storage": map[string]interface{}{
+							"resources": map[string]interface{}{
+								"requests": map[string]interface{}{"storage": "20Gi"},
+							},
+						},
+					},
+				},
+			},
+		},
+		"status": map[string]interface{}{"printableStatus": "Running"},
+	}}
+	running := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "kubevirt.io/v1",
+		"kind":       "VirtualMachineInstance",
+		"metadata":   map[string]interface{}{"name": "web", "namespace": "swift-abc"},
+		"spec":       machine.Object["spec"].(map[string]interface{})["template"].(map[string]interface{})["spec"],
+		"status": map[string]interface{}{
+			"phase":    "Running",
+			"nodeName": "node-1",
+			"interfaces": []interface{}{
+				map[string]interface{}{"name": "default", "ipAddress": "10.0.0.5", "ipAddresses": []interface{}{"10.0.0.5", "fd00::5"}},
+			},
+		},
+	}}
+
+	instance, err := newInstance(machine, running)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance.Name != "web" || instance.Project != "swift-abc" || instance.State != "Running" || instance.Node != "node-1" {
+		t.Errorf("unexpected identity %+v", instance)
+	}
+	if instance.VCPU != 2 || instance.RAM != "2Gi" {
+		t.Errorf("unexpected compute %d vcpu, %s ram", instance.VCPU, instance.RAM)
+	}
+	if len(instance.IPs) != 2 || instance.IPs[1] != "fd00::5" {
+		t.Errorf("unexpected ips %v", instance.IPs)
+	}
+	if len(instance.Disks) != 2 || instance.Disks[0].Size != "20Gi" || instance.Disks[1].Type != "cdrom" {
+		t.Errorf("unexpected disks %+v", instance.Disks)
+	}
+	if instance.Created.IsZero() {
+		t.Error("expected the creation time of the virtual machine")
+	}
+
+	stopped, err := newInstance(machine, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stopped.Node != "" || len(stopped.IPs) != 0 || stopped.VCPU != 2 {
+		t.Errorf("unexpected stopped instance %+v", stopped)
+	}
+}
@@ -0,0 +1,175 @@
+package vm
+
+import (
+	"cloud/internal/clusters"
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	k8sv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+// PowerTimeout bounds how long a power action is waited on to reach the
+// phase it leads to.
+var PowerTimeout = 10 * time.Second
+
+// PowerState is the state of a virtual machine after a power action. Phase
+// is the last phase observed, and Complete is set once it is the phase the
+// action leads to.
+type PowerState struct {
+	Action   string `json:"action"`
+	Phase    string `json:"phase,omitempty"`
+	Complete bool   `json:"complete"`
+}
+
+// powerPhases are the phases the power actions lead to.
+var powerPhases = map[string]string{
+	"start":   "Running",
+	"stop":    "Stopped",
+	"restart": "Running",
+	"pause":   "Paused",
+	"unpause": "Running",
+}
+
+// Power runs the power action named in the request path against the
+// virtual machine, then waits up to PowerTimeout for the phase it leads to,
+// or until the virtual machine fails. Stop accepts a "mode" query value of
+// graceful (default) or force and an optional "grace_period" in seconds,
+// which restart honours as well.
+func (vm *VirtualMachine) Power() (*PowerState, error) {
+	vars := mux.Vars(vm.request)
+	name := vars["name"]
+	action := vars["action"]
+	mode, gracePeriod, err := powerOptions(action, vm.request.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+
+	kubevirt, err := clusters.KubevirtResourceSchema(vm.kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := clusters.WithTimeout(vm.ctx)
+	defer cancel()
+	vms := kubevirt.VirtualMachine(vm.project)
+	vmis := kubevirt.VirtualMachineInstance(vm.project)
+	// A restart is only over once a new instance runs, as the previous one
+	// is still running right after the action.
+	var previous types.UID
+	if action == "restart" {
+		if vmi, err := vmis.Get(ctx, name, metav1.GetOptions{}); err == nil {
+			previous = vmi.UID
+		}
+	}
+	switch action {
+	case "start":
+		err = vms.Start(ctx, name, &kubevirtv1.StartOptions{})
+	case "stop":
+		if mode == "force" {
+			// A forced stop skips the guest shutdown unless told otherwise.
+			if gracePeriod == nil {
+				gracePeriod = new(int64)
+			}
+			err = vms.ForceStop(ctx, name, &kubevirtv1.StopOptions{GracePeriod: gracePeriod})
+		} else {
+			err = vms.Stop(ctx, name, &kubevirtv1.StopOptions{GracePeriod: gracePeriod})
+		}
+	case "restart":
+		if mode == "force" {
+			if gracePeriod == nil {
+				gracePeriod = new(int64)
+			}
+			err = vms.ForceRestart(ctx, name, &kubevirtv1.RestartOptions{GracePeriodSeconds: gracePeriod})
+		} else {
+			err = vms.Restart(ctx, name, &kubevirtv1.RestartOptions{GracePeriodSeconds: gracePeriod})
+		}
+	case "pause":
+		err = vmis.Pause(ctx, name, &kubevirtv1.PauseOptions{})
+	case "unpause":
+		err = vmis.Unpause(ctx, name, &kubevirtv1.UnpauseOptions{})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state := &PowerState{Action: action}
+	waitCtx, cancelWait := context.WithTimeout(vm.ctx, PowerTimeout)
+	defer cancelWait()
+	err = wait.PollUntilContextCancel(waitCtx, 500*time.Millisecond, true, func(ctx context.Context) (bool, error) {
+		vmi, err := vmis.Get(ctx, name, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			vmi, err = nil, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		var over bool
+		state.Phase, over = powerPhase(action, previous, vmi)
+		return over, nil
+	})
+	if err != nil && !wait.Interrupted(err) {
+		return nil, err
+	}
+	state.Complete = err == nil && state.Phase == powerPhases[action]
+	return state, nil
+}
+
+// powerOptions validates the power action and the query values it is run
+// with, which only stop and restart take.
+func powerOptions(action string, query url.Values) (string, *int64, error) {
+	if _, ok := powerPhases[action]; !ok {
+		return "", nil, k8serrors.NewBadRequest(fmt.Sprintf("unsupported power action %q", action))
+	}
+	var gracePeriod *int64
+	if value := query.Get("grace_period"); value != "" {
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || seconds < 0 {
+			return "", nil, k8serrors.NewBadRequest("grace_period must be a non-negative number of seconds")
+		}
+		gracePeriod = &seconds
+	}
+	mode := query.Get("mode")
+	switch mode {
+	case "", "graceful", "force":
+	default:
+		return "", nil, k8serrors.NewBadRequest(fmt.Sprintf("unsupported mode %q, expected graceful or force", mode))
+	}
+	if (mode != "" || gracePeriod != nil) && action != "stop" && action != "restart" {
+		return "", nil, k8serrors.NewBadRequest(fmt.Sprintf("mode and grace_period only apply to stop and restart, not %s", action))
+	}
+	return mode, gracePeriod, nil
+}
+
+// powerPhase returns the phase a virtual machine is in after a power
+// action, Stopped when it has no instance, and whether waiting is over: the
+// phase is the one the action leads to, or a new instance failed. The
+// instance a restart started from is never the one waited for.
+func powerPhase(action string, previous types.UID, vmi *kubevirtv1.VirtualMachineInstance) (string, bool) {
+	if vmi == nil {
+		return "Stopped", powerPhases[action] == "Stopped"
+	}
+	phase := instancePhase(vmi)
+	if vmi.UID == previous {
+		return phase, false
+	}
+	return phase, phase == powerPhases[action] || phase == string(kubevirtv1.Failed)
+}
+
+// instancePhase is the phase of a virtual machine instance, reporting paused
+// instances as such.
+func instancePhase(vmi *kubevirtv1.VirtualMachineInstance) string {
+	for _, condition := range vmi.Status.Conditions {
+		if condition.Type == kubevirtv1.VirtualMachineInstancePaused && condition.Status == k8sv1.ConditionTrue {
+			return "Paused"
+		}
+	}
+	return string(vmi.Status.Phase)
+}
@@ -0,0 +1,96 @@
+package vm
+
+import (
+	"net/url"
+	"testing"
+
+	k8sv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+func testVMI(uid types.UID, phase kubevirtv1.VirtualMachineInstancePhase, paused bool) *kubevirtv1.VirtualMachineInstance {
+	vmi := &kubevirtv1.VirtualMachineInstance{
+		ObjectMeta: metav1.ObjectMeta{UID: uid},
+		Status:     kubevirtv1.VirtualMachineInstanceStatus{Phase: phase},
+	}
+	if paused {
+		vmi.Status.Conditions = []kubevirtv1.VirtualMachineInstanceCondition{
+			{Type: kubevirtv1.VirtualMachineInstancePaused, Status: k8sv1.ConditionTrue},
+		}
+	}
+	return vmi
+}
+
+func TestPowerOptions(t *testing.T) {
+	tests := []struct {
+		action string
+		query  string
+		mode   string
+		grace  int64
+		valid  bool
+	}{
+		{action: "start", valid: true},
+		{action: "stop", query: "mode=force&grace_period=30", mode: "force", grace: 30, valid: true},
+		{action: "restart", query: "mode=graceful", mode: "graceful", grace: -1, valid: true},
+		{action: "stop", query: "mode=hard"},
+		{action: "stop", query: "grace_period=-5"},
+		{action: "pause", query: "mode=force"},
+		{action: "unpause", query: "grace_period=10"},
+		{action: "start", query: "mode=force"},
+		{action: "reboot"},
+	}
+	for _, test := range tests {
+		query, _ := url.ParseQuery(test.query)
+		mode, grace, err := powerOptions(test.action, query)
+		if !test.valid {
+			if !k8serrors.IsBadRequest(err) {
+				t.Errorf("%s?%s: expected a bad request, got %v", test.action, test.query, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s?%s: unexpected error %v", test.action, test.query, err)
+			continue
+		}
+		if mode != test.mode {
+			t.Errorf("%s?%s: expected mode %q, got %q", test.action, test.query, test.mode, mode)
+		}
+		if (grace == nil) != (test.grace <= 0) || (grace != nil && *grace != test.grace) {
+			t.Errorf("%s?%s: expected grace period %d, got %v", test.action, test.query, test.grace, grace)
+		}
+	}
+}
+
+func TestPowerPhase(t *testing.T) {
+	tests := []struct {
+		name     string
+		action   string
+		previous types.UID
+		vmi      *kubevirtv1.VirtualMachineInstance
+		phase    string
+		over     bool
+	}{
+		{"started", "start", "", testVMI("a", kubevirtv1.Running, false), "Running", true},
+		{"still starting", "start", "", testVMI("a", kubevirtv1.Scheduling, false), "Scheduling", false},
+		{"failed to start", "start", "", testVMI("a", kubevirtv1.Failed, false), "Failed", true},
+		{"stopped", "stop", "", nil, "Stopped", true},
+		{"still stopping", "stop", "", testVMI("a", kubevirtv1.Running, false), "Running", false},
+		{"not started yet", "start", "", nil, "Stopped", false},
+		{"paused", "pause", "", testVMI("a", kubevirtv1.Running, true), "Paused", true},
+		{"unpaused", "unpause", "", testVMI("a", kubevirtv1.Running, false), "Running", true},
+		{"restart on the previous instance", "restart", "a", testVMI("a", kubevirtv1.Running, false), "Running", false},
+		{"previous instance failed", "restart", "a", testVMI("a", kubevirtv1.Failed, false), "Failed", false},
+		{"restarted", "restart", "a", testVMI("b", kubevirtv1.Running, false), "Running", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			phase, over := powerPhase(test.action, test.previous, test.vmi)
+			if phase != test.phase || over != test.over {
+				t.Errorf("expected %s over=%v, got %s over=%v", test.phase, test.over, phase, over)
+			}
+		})
+	}
+}
@@ -0,0 +1,357 @@
+package vm
+
+import (
+	"cloud/internal/clusters"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/gorilla/mux"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+var restoreGVK = schema.GroupVersionKind{
+	Group:   "snapshot.kubevirt.io",
+	Version: "v1beta1",
+	Kind:    "VirtualMachineRestore",
+}
+
+// startAfterRestoreLabel marks restores in place of a running virtual
+// machine, which is started again once the restore is over.
+const startAfterRestoreLabel = "anvil.io/start-after-restore"
+
+// RestoreTimeout bounds how long a virtual machine restored in place is
+// waited on to be started again.
+var RestoreTimeout = 30 * time.Minute
+
+// RestoreRequest is the request body of restoring a virtual machine from one
+// of its snapshots. The snapshot is restored into the virtual machine itself
+// unless a target naming a new one is given. Running virtual machines are
+// only restored in place with force, which stops them first and starts them
+// again once restored.
+type RestoreRequest struct {
+	Snapshot string `json:"snapshot"`
+	Target   string `json:"target,omitempty"`
+	Force    bool   `json:"force,omitempty"`
+}
+
+// Restore is the representation of the progress of a restore.
+type Restore struct {
+	Name       string      `json:"name"`
+	Snapshot   string      `json:"snapshot"`
+	Target     string      `json:"target"`
+	Phase      string      `json:"phase"`
+	Complete   bool        `json:"complete"`
+	Restored   *time.Time  `json:"restored,omitempty"`
+	Conditions []Condition `json:"conditions"`
+}
+
+// Restore restores the virtual machine named in the request path from a
+// snapshot. It returns once the restore has been created, use WaitRestore or
+// WatchRestore to follow its progress. admit, when given, is called with the
+// resources of the snapshot before restoring it into a new virtual machine,
+// and its error is returned as is.
+func (vm *VirtualMachine) Restore(admit func(clusters.ResourceDetails) error) (*Restore, error) {
+	name := mux.Vars(vm.request)["name"]
+	request := RestoreRequest{}
+	if err := json.NewDecoder(vm.request.Body).Decode(&request); err != nil {
+		return nil, err
+	}
+	if err := clusters.NewValidationError(request.validate()); err != nil {
+		return nil, err
+	}
+	inPlace := request.Target == "" || request.Target == name
+	if inPlace {
+		request.Target = name
+	}
+
+	ctx, cancel := clusters.WithTimeout(vm.ctx)
+	defer cancel()
+	snapshot, err := clusters.GetResourceSchema(ctx, snapshotGVK, request.Snapshot, vm.kubeconfig, vm.project)
+	if err != nil {
+		return nil, err
+	}
+	if source, _, _ := unstructured.NestedString(snapshot.Object, "spec", "source", "name"); source != name {
+		return nil, k8serrors.NewNotFound(schema.GroupResource{Group: snapshotGVK.Group, Resource: "virtualmachinesnapshots"}, request.Snapshot)
+	}
+	if ready, _, _ := unstructured.NestedBool(snapshot.Object, "status", "readyToUse"); !ready {
+		return nil, conflict("virtualmachinesnapshots", request.Snapshot, "the snapshot is not ready to use yet")
+	}
+
+	running := false
+	if inPlace {
+		vmi, err := clusters.GetResourceSchema(ctx, GVKs[1], name, vm.kubeconfig, vm.project)
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return nil, err
+		}
+		running = err == nil && instanceActive(vmi)
+		if running && !request.Force {
+			return nil, conflict("virtualmachines", name, "the virtual machine is running, stop it first or restore with force")
+		}
+	} else {
+		_, err := clusters.GetResourceSchema(ctx, GVKs[0], request.Target, vm.kubeconfig, vm.project)
+		if err == nil {
+			return nil, k8serrors.NewAlreadyExists(schema.GroupResource{Group: GVKs[0].Group, Resource: "virtualmachines"}, request.Target)
+		}
+		if !k8serrors.IsNotFound(err) {
+			return nil, err
+		}
+		if admit != nil {
+			compute, err := vm.snapshotCompute(ctx, snapshot, request.Target)
+			if err != nil {
+				return nil, err
+			}
+			if err := admit(clusters.ResourceDetails{Compute: compute}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// The restore is created before the virtual machine is stopped, so that
+	// a restore that cannot be created leaves the virtual machine running.
+	// KubeVirt waits for the virtual machine to stop before restoring it.
+	obj := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": restoreGVK.GroupVersion().String(),
+			"kind":       restoreGVK.Kind,
+			"metadata": map[string]interface{}{
+				"generateName": request.Target + "-restore-",
+			},
+			"spec": map[string]interface{}{
+				"target": map[string]interface{}{
+					"apiGroup": GVKs[0].Group,
+					"kind":     GVKs[0].Kind,
+					"name":     request.Target,
+				},
+				"virtualMachineSnapshotName": request.Snapshot,
+			},
+		},
+	}
+	if running {
+		obj.SetLabels(map[string]string{startAfterRestoreLabel: "true"})
+	}
+	restore, err := clusters.CreateResourceSchema(ctx, obj, vm.kubeconfig, vm.project)
+	if err != nil {
+		return nil, err
+	}
+	if running {
+		if err := vm.stop(ctx, name); err != nil {
+			if err := clusters.DeleteResourceSchema(vm.ctx, restoreGVK, restore.GetName(), vm.kubeconfig, vm.project); err != nil {
+				slog.Error("Unable to delete the restore of a virtual machine that failed to stop", "restore", restore.GetName(), "name", name, "error", err.Error())
+			}
+			return nil, err
+		}
+		// The restore outlives the request, so the virtual machine is
+		// started again in the background once it completes. Restores
+		// still labelled after a restart are resumed by ResumeRestores.
+		go vm.startAfterRestore(restore.GetName(), name)
+	}
+	return NewRestore(restore), nil
+}
+
+// FindRestore gets a restore of the virtual machine named in the request
+// path.
+func (vm *VirtualMachine) FindRestore() (*Restore, error) {
+	vars := mux.Vars(vm.request)
+	ctx, cancel := clusters.WithTimeout(vm.ctx)
+	defer cancel()
+	restore, err := clusters.GetResourceSchema(ctx, restoreGVK, vars["restore"], vm.kubeconfig, vm.project)
+	if err != nil {
+		return nil, err
+	}
+	r := NewRestore(restore)
+	if r.Target != vars["name"] {
+		return nil, k8serrors.NewNotFound(schema.GroupResource{Group: restoreGVK.Group, Resource: "virtualmachinerestores"}, vars["restore"])
+	}
+	return r, nil
+}
+
+// WatchRestore watches the progress of a restore.
+func (vm *VirtualMachine) WatchRestore(name string) (watch.Interface, error) {
+	return clusters.WatchResourceSchema(vm.ctx, restoreGVK, vm.kubeconfig, vm.project, metav1.ListOptions{
+		FieldSelector: "metadata.name=" + name,
+	})
+}
+
+// WaitRestore waits up to timeout for a restore to complete, returning its
+// latest progress either way.
+func (vm *VirtualMachine) WaitRestore(restore *Restore, timeout time.Duration) (*Restore, error) {
+	if restore.Complete {
+		return restore, nil
+	}
+	ctx, cancel := context.WithTimeout(vm.ctx, timeout)
+	defer cancel()
+	watcher, err := clusters.WatchResourceSchema(ctx, restoreGVK, vm.kubeconfig, vm.project, metav1.ListOptions{
+		FieldSelector: "metadata.name=" + restore.Name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer watcher.Stop()
+	for event := range watcher.ResultChan() {
+		obj, ok := event.Object.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		restore = NewRestore(obj)
+		if restore.Complete {
+			break
+		}
+	}
+	return restore, nil
+}
+
+// snapshotCompute describes the resources of the virtual machine captured
+// in a snapshot, as restored into the target.
+func (vm *VirtualMachine) snapshotCompute(ctx context.Context, snapshot *unstructured.Unstructured, target string) (clusters.Compute, error) {
+	contentName, _, _ := unstructured.NestedString(snapshot.Object, "status", "virtualMachineSnapshotContentName")
+	content, err := clusters.GetResourceSchema(ctx, snapshotContentGVK, contentName, vm.kubeconfig, vm.project)
+	if err != nil {
+		return clusters.Compute{}, err
+	}
+	return snapshotCompute(target, content)
+}
+
+// stop stops a virtual machine, as a virtual machine is only restored once
+// stopped. The guest is not shut down gracefully since the restore discards
+// the state of its disks anyway.
+func (vm *VirtualMachine) stop(ctx context.Context, name string) error {
+	kubevirt, err := clusters.KubevirtResourceSchema(vm.kubeconfig)
+	if err != nil {
+		return err
+	}
+	return kubevirt.VirtualMachine(vm.project).ForceStop(ctx, name, &kubevirtv1.StopOptions{GracePeriod: new(int64)})
+}
+
+// ResumeRestores starts again the virtual machines of restores in place
+// that were still in progress when the server last stopped.
+func ResumeRestores(ctx context.Context, kubeconfig string) error {
+	list, err := clusters.ListResourceSchema(ctx, restoreGVK, kubeconfig, metav1.NamespaceAll, metav1.ListOptions{
+		LabelSelector: startAfterRestoreLabel + "=true",
+	})
+	if err != nil {
+		return err
+	}
+	for i := range list.Items {
+		restore := &list.Items[i]
+		vm := &VirtualMachine{ctx: ctx, kubeconfig: kubeconfig, project: restore.GetNamespace()}
+		go vm.startAfterRestore(restore.GetName(), NewRestore(restore).Target)
+	}
+	return nil
+}
+
+// startAfterRestore starts a virtual machine once a restore into it is over.
+// The virtual machine is started even when the restore does not complete in
+// time, rather than being left stopped for good.
+func (vm *VirtualMachine) startAfterRestore(restore, name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), RestoreTimeout)
+	defer cancel()
+	err := wait.PollUntilContextCancel(ctx, 5*time.Second, false, func(ctx context.Context) (bool, error) {
+		obj, err := clusters.GetResourceSchema(ctx, restoreGVK, restore, vm.kubeconfig, vm.project)
+		if k8serrors.IsNotFound(err) {
+			return true, nil
+		}
+		if err != nil {
+			// Transient failures are retried until the timeout.
+			return false, nil
+		}
+		return NewRestore(obj).Complete, nil
+	})
+	if err != nil {
+		slog.Error("Restore did not complete, starting the virtual machine anyway", "restore", restore, "name", name, "error", err.Error())
+	}
+	ctx, cancel = clusters.WithTimeout(context.Background())
+	defer cancel()
+	kubevirt, err := clusters.KubevirtResourceSchema(vm.kubeconfig)
+	if err == nil {
+		err = kubevirt.VirtualMachine(vm.project).Start(ctx, name, &kubevirtv1.StartOptions{})
+	}
+	if err != nil && !k8serrors.IsConflict(err) {
+		slog.Error("Unable to start the restored virtual machine", "restore", restore, "name", name, "error", err.Error())
+		return
+	}
+	patch := []byte(`{"metadata":{"labels":{"` + startAfterRestoreLabel + `":null}}}`)
+	_, err = clusters.PatchResourceSchema(ctx, restore, vm.kubeconfig, vm.project, restoreGVK, patch, types.MergePatchType)
+	if err != nil && !k8serrors.IsNotFound(err) {
+		slog.Error("Unable to unlabel the restore", "restore", restore, "name", name, "error", err.Error())
+	}
+}
+
+func (r RestoreRequest) validate() field.ErrorList {
+	errs := field.ErrorList{}
+	snapshot := field.NewPath("snapshot")
+	if r.Snapshot == "" {
+		errs = append(errs, field.Required(snapshot, ""))
+	}
+	if r.Target != "" {
+		for _, msg := range validation.IsDNS1123Label(r.Target) {
+			errs = append(errs, field.Invalid(field.NewPath("target"), r.Target, msg))
+		}
+	}
+	return errs
+}
+
+// NewRestore converts a VirtualMachineRestore.
+func NewRestore(obj *unstructured.Unstructured) *Restore {
+	restore := &Restore{
+		Name:       obj.GetName(),
+		Phase:      "Pending",
+		Conditions: []Condition{},
+	}
+	restore.Snapshot, _, _ = unstructured.NestedString(obj.Object, "spec", "virtualMachineSnapshotName")
+	restore.Target, _, _ = unstructured.NestedString(obj.Object, "spec", "target", "name")
+	restore.Complete, _, _ = unstructured.NestedBool(obj.Object, "status", "complete")
+	if restored, _, _ := unstructured.NestedString(obj.Object, "status", "restoreTime"); restored != "" {
+		if t, err := time.Parse(time.RFC3339, restored); err == nil {
+			restore.Restored = &t
+		}
+	}
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, c := range conditions {
+		c, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		condition := Condition{}
+		condition.Type, _, _ = unstructured.NestedString(c, "type")
+		condition.Status, _, _ = unstructured.NestedString(c, "status")
+		condition.Reason, _, _ = unstructured.NestedString(c, "reason")
+		condition.Message, _, _ = unstructured.NestedString(c, "message")
+		if changed, _, _ := unstructured.NestedString(c, "lastTransitionTime"); changed != "" {
+			condition.Changed, _ = time.Parse(time.RFC3339, changed)
+		}
+		restore.Conditions = append(restore.Conditions, condition)
+	}
+	switch {
+	case restore.Complete:
+		restore.Phase = "Complete"
+	case len(restore.Conditions) > 0:
+		restore.Phase = "InProgress"
+	}
+	return restore
+}
+
+// conflict reports a request that cannot be carried out in the current
+// state of a resource.
+func conflict(resource, name, message string) error {
+	return k8serrors.NewConflict(schema.GroupResource{Resource: resource}, name, errors.New(message))
+}
+
+// instanceActive reports whether a virtual machine instance has not
+// finished yet. Instances that succeeded or failed linger until the virtual
+// machine is started again, but are not running.
+func instanceActive(vmi *unstructured.Unstructured) bool {
+	phase, _, _ := unstructured.NestedString(vmi.Object, "status", "phase")
+	return phase != string(kubevirtv1.Succeeded) && phase != string(kubevirtv1.Failed)
+}
@@ -0,0 +1,259 @@
+package vm
+
+import (
+	"cloud/internal/clusters"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+var (
+	snapshotGVK = schema.GroupVersionKind{
+		Group:   "snapshot.kubevirt.io",
+		Version: "v1beta1",
+		Kind:    "VirtualMachineSnapshot",
+	}
+	snapshotContentGVK = schema.GroupVersionKind{
+		Group:   "snapshot.kubevirt.io",
+		Version: "v1beta1",
+		Kind:    "VirtualMachineSnapshotContent",
+	}
+)
+
+// Snapshot is the representation of a point-in-time copy of a virtual
+// machine.
+type Snapshot struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+	Phase  string `json:"phase"`
+	Ready  bool   `json:"ready"`
+	Size   string `json:"size,omitempty"`
+	Online bool   `json:"online"`
+	// GuestAgentFrozen is set when the guest filesystems were frozen through
+	// the guest agent while the snapshot was taken.
+	GuestAgentFrozen bool       `json:"guest_agent_frozen"`
+	Indications      []string   `json:"indications"`
+	Error            string     `json:"error,omitempty"`
+	Created          time.Time  `json:"created"`
+	Taken            *time.Time `json:"taken,omitempty"`
+}
+
+// SnapshotRequest is the request body of taking a snapshot. The name
+// defaults to one derived from the virtual machine and the current time.
+type SnapshotRequest struct {
+	Name string `json:"name,omitempty"`
+}
+
+// CreateSnapshot takes a snapshot of the virtual machine named in the
+// request path.
+func (vm *VirtualMachine) CreateSnapshot() (*Snapshot, error) {
+	name := mux.Vars(vm.request)["name"]
+	request := SnapshotRequest{}
+	if err := json.NewDecoder(vm.request.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if request.Name == "" {
+		request.Name = fmt.Sprintf("%s-%s", name, time.Now().UTC().Format("20060102-150405"))
+	}
+	errs := field.ErrorList{}
+	for _, msg := range validation.IsDNS1123Subdomain(request.Name) {
+		errs = append(errs, field.Invalid(field.NewPath("name"), request.Name, msg))
+	}
+	if err := clusters.NewValidationError(errs); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := clusters.WithTimeout(vm.ctx)
+	defer cancel()
+	// The virtual machine is looked up first to report a missing one
+	// clearly, rather than as a snapshot that never becomes ready.
+	if _, err := clusters.GetResourceSchema(ctx, GVKs[0], name, vm.kubeconfig, vm.project); err != nil {
+		return nil, err
+	}
+	obj := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": snapshotGVK.GroupVersion().String(),
+			"kind":       snapshotGVK.Kind,
+			"metadata": map[string]interface{}{
+				"name": request.Name,
+			},
+			"spec": map[string]interface{}{
+				"source": map[string]interface{}{
+					"apiGroup": GVKs[0].Group,
+					"kind":     GVKs[0].Kind,
+					"name":     name,
+				},
+			},
+		},
+	}
+	snapshot, err := clusters.CreateResourceSchema(ctx, obj, vm.kubeconfig, vm.project)
+	if err != nil {
+		return nil, err
+	}
+	return newSnapshot(snapshot, nil), nil
+}
+
+// FindSnapshots lists the snapshots of the virtual machine named in the
+// request path, oldest first.
+func (vm *VirtualMachine) FindSnapshots() ([]*Snapshot, error) {
+	name := mux.Vars(vm.request)["name"]
+	ctx, cancel := clusters.WithTimeout(vm.ctx)
+	defer cancel()
+	list, err := clusters.ListResourceSchema(ctx, snapshotGVK, vm.kubeconfig, vm.project, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	contents, err := clusters.ListResourceSchema(ctx, snapshotContentGVK, vm.kubeconfig, vm.project, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	contentsByName := map[string]*unstructured.Unstructured{}
+	for i := range contents.Items {
+		contentsByName[contents.Items[i].GetName()] = &contents.Items[i]
+	}
+	snapshots := []*Snapshot{}
+	for i := range list.Items {
+		item := &list.Items[i]
+		if source, _, _ := unstructured.NestedString(item.Object, "spec", "source", "name"); source != name {
+			continue
+		}
+		contentName, _, _ := unstructured.NestedString(item.Object, "status", "virtualMachineSnapshotContentName")
+		snapshots = append(snapshots, newSnapshot(item, contentsByName[contentName]))
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].Created.Before(snapshots[j].Created)
+	})
+	return snapshots, nil
+}
+
+// FindSnapshot gets a snapshot of the virtual machine named in the request
+// path.
+func (vm *VirtualMachine) FindSnapshot() (*Snapshot, error) {
+	snapshot, err := vm.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := clusters.WithTimeout(vm.ctx)
+	defer cancel()
+	var content *unstructured.Unstructured
+	if contentName, _, _ := unstructured.NestedString(snapshot.Object, "status", "virtualMachineSnapshotContentName"); contentName != "" {
+		content, err = clusters.GetResourceSchema(ctx, snapshotContentGVK, contentName, vm.kubeconfig, vm.project)
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return nil, err
+		}
+	}
+	return newSnapshot(snapshot, content), nil
+}
+
+// DeleteSnapshot deletes a snapshot of the virtual machine named in the
+// request path, along with the volume snapshots holding its data.
+func (vm *VirtualMachine) DeleteSnapshot() error {
+	snapshot, err := vm.snapshot()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := clusters.WithTimeout(vm.ctx)
+	defer cancel()
+	return clusters.DeleteResourceSchema(ctx, snapshotGVK, snapshot.GetName(), vm.kubeconfig, vm.project)
+}
+
+// snapshot gets the snapshot named in the request path, reporting it as not
+// found when it is not a snapshot of the virtual machine of the path.
+func (vm *VirtualMachine) snapshot() (*unstructured.Unstructured, error) {
+	vars := mux.Vars(vm.request)
+	ctx, cancel := clusters.WithTimeout(vm.ctx)
+	defer cancel()
+	snapshot, err := clusters.GetResourceSchema(ctx, snapshotGVK, vars["snapshot"], vm.kubeconfig, vm.project)
+	if err != nil {
+		return nil, err
+	}
+	if source, _, _ := unstructured.NestedString(snapshot.Object, "spec", "source", "name"); source != vars["name"] {
+		return nil, k8serrors.NewNotFound(schema.GroupResource{Group: snapshotGVK.Group, Resource: "virtualmachinesnapshots"}, vars["snapshot"])
+	}
+	return snapshot, nil
+}
+
+// newSnapshot converts a VirtualMachineSnapshot. Its size is the sum of the
+// volumes backed up in its content, when known.
+func newSnapshot(obj, content *unstructured.Unstructured) *Snapshot {
+	snapshot := &Snapshot{
+		Name:        obj.GetName(),
+		Created:     obj.GetCreationTimestamp().Time,
+		Indications: []string{},
+	}
+	snapshot.Source, _, _ = unstructured.NestedString(obj.Object, "spec", "source", "name")
+	snapshot.Phase, _, _ = unstructured.NestedString(obj.Object, "status", "phase")
+	snapshot.Ready, _, _ = unstructured.NestedBool(obj.Object, "status", "readyToUse")
+	snapshot.Error, _, _ = unstructured.NestedString(obj.Object, "status", "error", "message")
+	if indications, _, _ := unstructured.NestedStringSlice(obj.Object, "status", "indications"); indications != nil {
+		snapshot.Indications = indications
+	}
+	for _, indication := range snapshot.Indications {
+		switch indication {
+		case "Online":
+			snapshot.Online = true
+		case "GuestAgent":
+			snapshot.GuestAgentFrozen = true
+		}
+	}
+	if taken, _, _ := unstructured.NestedString(obj.Object, "status", "creationTime"); taken != "" {
+		if t, err := time.Parse(time.RFC3339, taken); err == nil {
+			snapshot.Taken = &t
+		}
+	}
+	if content != nil {
+		snapshot.Size = backupSize(content)
+	}
+	return snapshot
+}
+
+// backupSize sums the volumes backed up in a snapshot content, or returns an
+// empty string when their sizes are unknown.
+func backupSize(content *unstructured.Unstructured) string {
+	backups, _, _ := unstructured.NestedSlice(content.Object, "spec", "volumeBackups")
+	total := resource.Quantity{}
+	for _, backup := range backups {
+		backup, ok := backup.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		size, _, _ := unstructured.NestedString(backup, "persistentVolumeClaim", "spec", "resources", "requests", "storage")
+		if quantity, err := resource.ParseQuantity(size); err == nil {
+			total.Add(quantity)
+		}
+	}
+	if total.IsZero() {
+		return ""
+	}
+	return total.String()
+}
+
+// snapshotCompute describes the resources of the virtual machine captured
+// in a snapshot content, which a restore into a new virtual machine takes
+// from the quota of the project.
+func snapshotCompute(name string, content *unstructured.Unstructured) (clusters.Compute, error) {
+	compute := clusters.Compute{Name: name, Storage: backupSize(content)}
+	source, found, _ := unstructured.NestedMap(content.Object, "spec", "source", "virtualMachine")
+	if !found {
+		return compute, nil
+	}
+	instance, err := newInstance(&unstructured.Unstructured{Object: source}, nil)
+	if err != nil {
+		return compute, err
+	}
+	compute.CPU = float64(instance.VCPU)
+	compute.RAM = instance.RAM
+	return compute, nil
+}
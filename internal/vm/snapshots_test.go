@@ -0,0 +1,130 @@
+package vm
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestNewSnapshot(t *testing.T) {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "web-nightly"},
+		"spec": map[string]interface{}{
+			"source": map[string]interface{}{"name": "web"},
+		},
+		"status": map[string]interface{}{
+			"phase":        "Succeeded",
+			"readyToUse":   true,
+			"creationTime": "2026-10-18T09:00:00Z",
+			"indications":  []interface{}{"Online", "GuestAgent"},
+		},
+	}}
+	content := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"volumeBackups": []interface{}{
+				map[string]interface{}{"persistentVolumeClaim": map[string]interface{}{
+					"spec": map[string]interface{}{"resources": map[string]interface{}{"requests": map[string]interface{}{"storage": "10Gi"}}},
+				}},
+				map[string]interface{}{"persistentVolumeClaim": map[string]interface{}{
+					"spec": map[string]interface{}{"resources": map[string]interface{}{"requests": map[string]interface{}{"storage": "20Gi"}}},
+				}},
+			},
+		},
+	}}
+	snapshot := newSnapshot(obj, content)
+	if snapshot.Source != "web" || !snapshot.Ready || snapshot.Phase != "Succeeded" {
+		t.Errorf("unexpected snapshot %+v", snapshot)
+	}
+	if !snapshot.Online || !snapshot.GuestAgentFrozen {
+		t.Errorf("expected the indications to be reported, got %+v", snapshot)
+	}
+	if snapshot.Size != "30Gi" || snapshot.Taken == nil {
+		t.Errorf("unexpected size %q or time %v", snapshot.Size, snapshot.Taken)
+	}
+	if pending := newSnapshot(&unstructured.Unstructured{Object: map[string]interface{}{}}, nil); pending.Indications == nil || pending.Size != "" {
+		t.Errorf("unexpected pending snapshot %+v", pending)
+	}
+}
+
+func TestSnapshotCompute(t *testing.T) {
+	content := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"source": map[string]interface{}{
+				"virtualMachine": map[string]interface{}{
+					"metadata": map[string]interface{}{"name": "web"},
+					"spec": map[string]interface{}{
+						"template": map[string]interface{}{
+							"spec": map[string]interface{}{
+								"domain": map[string]interface{}{
+									"cpu":       map[string]interface{}{"cores": int64(2), "sockets": int64(2)},
+									"resources": map[string]interface{}{"limits": map[string]interface{}{"memory": "4Gi"}},
+								},
+							},
+						},
+					},
+				},
+			},
+			"volumeBackups": []interface{}{
+				map[string]interface{}{"persistentVolumeClaim": map[string]interface{}{
+					"spec": map[string]interface{}{"resources": map[string]interface{}{"requests": map[string]interface{}{"storage": "10Gi"}}},
+				}},
+			},
+		},
+	}}
+	compute, err := snapshotCompute("web-copy", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compute.Name != "web-copy" || compute.CPU != 4 || compute.RAM != "4Gi" || compute.Storage != "10Gi" {
+		t.Errorf("unexpected compute %+v", compute)
+	}
+}
+
+func TestNewRestore(t *testing.T) {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "web-restore"},
+		"spec": map[string]interface{}{
+			"target":                     map[string]interface{}{"name": "web"},
+			"virtualMachineSnapshotName": "web-nightly",
+		},
+	}}
+	if restore := NewRestore(obj); restore.Phase != "Pending" || restore.Target != "web" || restore.Snapshot != "web-nightly" {
+		t.Errorf("unexpected pending restore %+v", restore)
+	}
+	obj.Object["status"] = map[string]interface{}{
+		"complete":    true,
+		"restoreTime": "2026-10-18T09:00:00Z",
+		"conditions": []interface{}{
+			map[string]interface{}{"type": "Ready", "status": "True", "reason": "Operation complete"},
+		},
+	}
+	restore := NewRestore(obj)
+	if restore.Phase != "Complete" || !restore.Complete || restore.Restored == nil || len(restore.Conditions) != 1 {
+		t.Errorf("unexpected complete restore %+v", restore)
+	}
+}
+
+func TestRestoreRequestValidate(t *testing.T) {
+	if errs := (RestoreRequest{Snapshot: "web-nightly", Target: "web-copy"}).validate(); len(errs) > 0 {
+		t.Errorf("expected a valid request, got %v", errs)
+	}
+	if errs := (RestoreRequest{Target: "Web_Copy"}).validate(); len(errs) != 2 {
+		t.Errorf("expected 2 errors, got %v", errs)
+	}
+}
+
+func TestInstanceActive(t *testing.T) {
+	for phase, active := range map[string]bool{
+		"Scheduling": true,
+		"Running":    true,
+		"Succeeded":  false,
+		"Failed":     false,
+	} {
+		vmi := &unstructured.Unstructured{Object: map[string]interface{}{
+			"status": map[string]interface{}{"phase": phase},
+		}}
+		if got := instanceActive(vmi); got != active {
+			t.Errorf("expected an instance in phase %s to be active %v, got %v", phase, active, got)
+		}
+	}
+}